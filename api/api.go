@@ -2,14 +2,23 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"dnslite/config"
 	"dnslite/db"
 	"dnslite/dnssec"
+	"dnslite/handler"
+	"dnslite/tsig"
+
+	"github.com/miekg/dns"
 )
 
 var (
@@ -17,18 +26,69 @@ var (
 	syncMu        sync.RWMutex
 )
 
+// ZoneFile is one zone in a /zone-sync answer: the whole zone in Records,
+// SOA first, or the current SOA alone with the journaled Diffs that lead to
+// it from the serial asked for. A zone already at that serial has just the
+// SOA.
 type ZoneFile struct {
-	Zone    string   `json:"zone"`
-	Records []string `json:"records"`
+	Zone    string     `json:"zone"`
+	Records []string   `json:"records,omitempty"`
+	SOA     string     `json:"soa,omitempty"`
+	Diffs   []ZoneDiff `json:"diffs,omitempty"`
+}
+
+// ZoneDiff is one journaled version of a zone, as in IXFR
+type ZoneDiff struct {
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Deleted []string `json:"deleted"`
+	Added   []string `json:"added"`
+}
+
+// ZoneSerial is the current serial of a zone, as listed by /zone-sync?serials
+type ZoneSerial struct {
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
 }
 
 func StartAPIServer(addr string) {
 	http.HandleFunc("/zone-sync", handleZoneSync)
 	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/ds", handleDS)
 	go http.ListenAndServe(addr, nil)
 }
 
 func handleZoneSync(w http.ResponseWriter, r *http.Request) {
+	if len(config.ZoneSyncKeys) == 0 && !config.InsecureSync {
+		log.Printf("⛔ Refused zone sync from %s: ZONE_SYNC_KEYS is not set", r.RemoteAddr)
+		http.Error(w, "Zone sync is not enabled", http.StatusForbidden)
+		return
+	}
+	if len(config.ZoneSyncKeys) > 0 {
+		key, err := tsig.VerifyRequest(r)
+		if err == nil && !slices.ContainsFunc(config.ZoneSyncKeys, func(k string) bool { return dns.CanonicalName(k) == key }) {
+			err = fmt.Errorf("key %s may not sync", key)
+		}
+		if err != nil {
+			log.Printf("⛔ Refused zone sync from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "TSIG authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	if query.Has("serials") {
+		serials, err := zoneSerials()
+		if err != nil {
+			log.Println("❌ Failed to load zone serials:", err)
+			http.Error(w, "Failed to load zones", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(serials)
+		return
+	}
+
 	log.Println("▶ Loading zones from database...")
 	zones, err := db.GetAllZoneNames()
 	if err != nil {
@@ -38,49 +98,133 @@ func handleZoneSync(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("✅ Loaded %d zones\n", len(zones))
 
+	// ?zone= narrows the dump to one zone, for a slave that was notified
+	if only := query.Get("zone"); only != "" {
+		only = dns.Fqdn(strings.ToLower(only))
+		var found []string
+		for _, zone := range zones {
+			if zone == only {
+				found = append(found, zone)
+			}
+		}
+		zones = found
+	}
+
+	// ?serial= is the copy the slave holds, so only what changed since is
+	// sent when the journal has it
+	since, err := strconv.ParseUint(query.Get("serial"), 10, 32)
+	hasSince := err == nil
+
 	var zoneFiles []ZoneFile
 
 	for _, zone := range zones {
-		log.Printf("Manually checking RRSet keys for %s", zone)
-		pairs, err := db.GetRRSetKeysForZone(zone)
-		log.Printf("%s pairs = %+v, err = %v", zone, pairs, err)
-		if err != nil {
-			log.Printf("⚠️ Could not load RRSetKeys for %s: %v\n", zone, err)
-			continue
-		}
-		log.Printf("🧾 Zone %s has %d RRSet keys\n", zone, len(pairs))
-
-		var zoneRecords []string
-		for _, p := range pairs {
-			rrset, err := db.QueryRecords(p.Name, p.Type)
+		if hasSince {
+			file, ok, err := zoneChanges(zone, uint32(since))
 			if err != nil {
-				log.Printf("⚠️ QueryRecords error: %v", err)
+				log.Printf("⚠️ Could not load changes of zone %s: %v\n", zone, err)
 				continue
 			}
-			sig, _ := db.QueryRRSIG(p.Name, p.Type)
-
-			for _, rr := range rrset {
-				log.Println("📦 RR:", rr.String())
-				zoneRecords = append(zoneRecords, rr.String())
-			}
-			if sig != nil {
-				log.Println("🔐 SIG:", sig.String())
-				zoneRecords = append(zoneRecords, sig.String())
+			if ok {
+				zoneFiles = append(zoneFiles, file)
+				continue
 			}
 		}
 
-		if len(zoneRecords) > 0 {
-			zoneFiles = append(zoneFiles, ZoneFile{
-				Zone:    zone,
-				Records: zoneRecords,
-			})
+		// The same records and signatures an AXFR of the zone carries,
+		// without the closing SOA
+		records, err := handler.ZoneContents(zone)
+		if err != nil {
+			log.Printf("⚠️ Could not load zone %s: %v\n", zone, err)
+			continue
 		}
+		log.Printf("🧾 Zone %s has %d records\n", zone, len(records)-1)
+
+		zoneFiles = append(zoneFiles, ZoneFile{
+			Zone:    zone,
+			Records: rrStrings(records[:len(records)-1]),
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(zoneFiles)
 }
 
+// zoneSerials lists every zone with its serial, in name order
+func zoneSerials() ([]ZoneSerial, error) {
+	serials, err := db.GetZoneSerials()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ZoneSerial, 0, len(serials))
+	for zone, serial := range serials {
+		list = append(list, ZoneSerial{Zone: zone, Serial: serial})
+	}
+	slices.SortFunc(list, func(a, b ZoneSerial) int { return strings.Compare(a.Zone, b.Zone) })
+	return list, nil
+}
+
+// zoneChanges returns what a slave holding zone at serial since needs to
+// catch up: the SOA alone if it is current, or the journaled differences.
+// It reports false when the journal does not reach back to since.
+func zoneChanges(zone string, since uint32) (ZoneFile, bool, error) {
+	soa, err := db.QuerySOA(zone)
+	if err != nil {
+		return ZoneFile{}, false, err
+	}
+	file := ZoneFile{Zone: zone, SOA: soa.String()}
+	if !db.SerialNewer(soa.Serial, since) {
+		return file, true, nil
+	}
+
+	diffs, err := handler.ZoneDiffs(zone, since, soa.Serial)
+	if err != nil || diffs == nil {
+		return ZoneFile{}, false, err
+	}
+	for _, diff := range diffs {
+		file.Diffs = append(file.Diffs, ZoneDiff{
+			From:    diff.From,
+			To:      diff.To,
+			Deleted: rrStrings(diff.Deleted),
+			Added:   rrStrings(diff.Added),
+		})
+	}
+	log.Printf("🧾 Zone %s changed in %d versions since serial %d\n", zone, len(diffs), since)
+	return file, true, nil
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	texts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		texts = append(texts, rr.String())
+	}
+	return texts
+}
+
+// handleDS prints the DS records to hand to the parent for ?zone=
+func handleDS(w http.ResponseWriter, r *http.Request) {
+	zone := r.URL.Query().Get("zone")
+	if zone == "" {
+		http.Error(w, "Missing zone parameter", http.StatusBadRequest)
+		return
+	}
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	records := []string{}
+	for _, ds := range dnssec.DSRecords(zone) {
+		records = append(records, ds.String())
+	}
+	if len(records) == 0 {
+		http.Error(w, "No active keys for zone", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"zone": zone,
+		"ds":   records,
+	})
+}
+
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	role := os.Getenv("SERVER_ROLE")
 	response := map[string]any{
@@ -89,6 +233,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	if role == "master" {
 		response["dnssec_zones"] = dnssec.GetAllZones()
+		response["dnssec_keys"] = dnssec.KeyStatus()
 		dbZones, _ := db.GetAllZoneNames()
 		response["db_zones"] = dbZones
 	} else if role == "slave" {
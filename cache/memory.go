@@ -3,11 +3,23 @@ package cache
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+
+	"dnslite/dnssec"
 
 	"github.com/miekg/dns"
 )
 
-var recordCache sync.Map
+var (
+	recordCache  sync.Map
+	chainCache   sync.Map
+	modeCache    sync.Map
+	sigCache     sync.Map
+	sigCacheSize atomic.Int64
+)
+
+// maxSignatures bounds the online signature cache; it is emptied once full
+const maxSignatures = 100000
 
 func key(name string, qtype uint16) string {
 	return fmt.Sprintf("%s:%d", name, qtype)
@@ -25,10 +37,72 @@ func Set(name string, qtype uint16, records []dns.RR) {
 	recordCache.Store(key(name, qtype), records)
 }
 
+// Delete drops the cached RRset of name/qtype
+func Delete(name string, qtype uint16) {
+	recordCache.Delete(key(name, qtype))
+}
+
+// GetChain returns the cached NSEC/NSEC3 chain of a zone
+func GetChain(zone string) *dnssec.Chain {
+	val, ok := chainCache.Load(zone)
+	if !ok {
+		return nil
+	}
+	return val.(*dnssec.Chain)
+}
+
+func SetChain(zone string, chain *dnssec.Chain) {
+	chainCache.Store(zone, chain)
+}
+
+// DeleteZone drops the cached NSEC/NSEC3 chain and signing mode of a zone
+// so they are reloaded
+func DeleteZone(zone string) {
+	chainCache.Delete(zone)
+	modeCache.Delete(zone)
+}
+
+// GetSigningMode returns the cached signing mode of a zone
+func GetSigningMode(zone string) (string, bool) {
+	val, ok := modeCache.Load(zone)
+	if !ok {
+		return "", false
+	}
+	return val.(string), true
+}
+
+func SetSigningMode(zone, mode string) {
+	modeCache.Store(zone, mode)
+}
+
+// GetSignatures returns the RRSIGs cached for an RRset content hash
+func GetSignatures(hash string) []dns.RR {
+	val, ok := sigCache.Load(hash)
+	if !ok {
+		return nil
+	}
+	return val.([]dns.RR)
+}
+
+func SetSignatures(hash string, sigs []dns.RR) {
+	if sigCacheSize.Add(1) > maxSignatures {
+		clearMap(&sigCache)
+		sigCacheSize.Store(1)
+	}
+	sigCache.Store(hash, sigs)
+}
+
 func Clear() {
-	recordCache.Range(func(k, v any) bool {
-		recordCache.Delete(k)
+	clearMap(&recordCache)
+	clearMap(&chainCache)
+	clearMap(&modeCache)
+	clearMap(&sigCache)
+	sigCacheSize.Store(0)
+}
+
+func clearMap(m *sync.Map) {
+	m.Range(func(k, v any) bool {
+		m.Delete(k)
 		return true
 	})
 }
-
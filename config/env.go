@@ -1,17 +1,236 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 var (
 	DBURL string
+
+	// EDNSUDPSize is the largest UDP payload we will send, whatever the
+	// client advertises. 1232 avoids IP fragmentation on most paths.
+	EDNSUDPSize uint16 = 1232
+
+	// SignatureValidity is how long new RRSIGs are valid. Each expiration is
+	// pulled forward by a random amount up to SignatureJitter so signatures
+	// made together do not all expire together, and the signer re-signs
+	// anything expiring within SignatureRefresh.
+	SignatureValidity = 14 * 24 * time.Hour
+	SignatureJitter   = 12 * time.Hour
+	SignatureRefresh  = 3 * 24 * time.Hour
+
+	// JournalVersions and JournalMaxAge bound how much change history is kept
+	// per zone for IXFR; zero means no limit of that kind
+	JournalVersions = 1000
+	JournalMaxAge   = 7 * 24 * time.Hour
+
+	// SecondaryZones maps each zone a slave transfers by AXFR/IXFR to its
+	// primaries, tried in order
+	SecondaryZones map[string][]Peer
+
+	// NotifySecondaries are the servers a master sends DNS NOTIFY to for
+	// every zone whose serial changes
+	NotifySecondaries []Peer
+
+	// MasterTSIGKey names the key NOTIFY from the MASTER_URL host must be
+	// signed with, if any; slaves also sign their /zone-sync requests with it
+	MasterTSIGKey string
+
+	// ZoneSyncKeys are the TSIG keys a master accepts on /zone-sync
+	// requests; when empty the endpoint is closed unless InsecureSync is set
+	ZoneSyncKeys []string
+
+	// InsecureSync opts out of authenticating the HTTP sync: a master without
+	// ZoneSyncKeys serves /zone-sync to anyone, and a slave without
+	// MasterTSIGKey syncs unsigned and acts on unsigned NOTIFY from its master
+	InsecureSync bool
 )
 
+// Peer is another DNS server we talk to, and the TSIG key that signs the
+// messages between us ("" for none). Written as host[:port][/key].
+type Peer struct {
+	Addr string
+	Key  string
+}
+
+// ParsePeer reads a host[:port][/key] peer; the port defaults to 53
+func ParsePeer(v string) Peer {
+	addr, key, _ := strings.Cut(v, "/")
+	return Peer{Addr: DNSAddr(addr), Key: key}
+}
+
+func (p Peer) String() string {
+	if p.Key == "" {
+		return p.Addr
+	}
+	return p.Addr + " key " + p.Key
+}
+
 func LoadEnv() {
 	DBURL = os.Getenv("DB_URL")
 	if DBURL == "" {
 		log.Fatal("DB_URL environment variable is not set")
 	}
+
+	if v := os.Getenv("EDNS_UDP_SIZE"); v != "" {
+		size, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || size < 512 {
+			log.Fatalf("EDNS_UDP_SIZE must be a number between 512 and 65535, got %q", v)
+		}
+		EDNSUDPSize = uint16(size)
+	}
+
+	SignatureValidity = durationEnv("SIGNATURE_VALIDITY", SignatureValidity)
+	SignatureJitter = durationEnv("SIGNATURE_JITTER", SignatureJitter)
+	SignatureRefresh = durationEnv("SIGNATURE_REFRESH", SignatureRefresh)
+	if SignatureJitter+SignatureRefresh >= SignatureValidity {
+		log.Fatal("SIGNATURE_JITTER + SIGNATURE_REFRESH must be shorter than SIGNATURE_VALIDITY")
+	}
+
+	if v := os.Getenv("IXFR_JOURNAL_VERSIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("IXFR_JOURNAL_VERSIONS must be a number, got %q", v)
+		}
+		JournalVersions = n
+	}
+	JournalMaxAge = durationEnv("IXFR_JOURNAL_MAX_AGE", JournalMaxAge)
+
+	zones, err := parseSecondaryZones(os.Getenv("SECONDARY_ZONES"))
+	if err != nil {
+		log.Fatalf("SECONDARY_ZONES: %v", err)
+	}
+	SecondaryZones = zones
+
+	for _, peer := range strings.FieldsFunc(os.Getenv("NOTIFY_SECONDARIES"), isListSeparator) {
+		NotifySecondaries = append(NotifySecondaries, ParsePeer(peer))
+	}
+	MasterTSIGKey = os.Getenv("MASTER_TSIG_KEY")
+	ZoneSyncKeys = strings.FieldsFunc(os.Getenv("ZONE_SYNC_KEYS"), isListSeparator)
+	if v := os.Getenv("ZONE_SYNC_INSECURE"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("ZONE_SYNC_INSECURE must be true or false, got %q", v)
+		}
+		InsecureSync = insecure
+	}
+}
+
+// TSIGKeys returns the TSIG keyring, from TSIG_KEYS or the file named by
+// TSIG_KEYS_FILE, as "[algorithm:]name:secret" entries
+func TSIGKeys() (string, error) {
+	keys, err := secretEnv("TSIG_KEYS")
+	return string(keys), err
+}
+
+// PeerKeys lists every TSIG key named in the environment, so they can be
+// checked against the keyring at startup
+func PeerKeys() []string {
+	peers := append([]Peer{}, NotifySecondaries...)
+	for _, primaries := range SecondaryZones {
+		peers = append(peers, primaries...)
+	}
+	peers = append(peers, Peer{Key: MasterTSIGKey})
+
+	keys := append([]string{}, ZoneSyncKeys...)
+	for _, p := range peers {
+		if p.Key != "" {
+			keys = append(keys, p.Key)
+		}
+	}
+	return keys
+}
+
+// DNSAddr adds the DNS port 53 to addr unless it has a port
+func DNSAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || unicode.IsSpace(r)
+}
+
+// parseSecondaryZones reads entries like "example.com=192.0.2.1/xfr-key"
+// separated by commas or spaces. A zone may be listed once per primary; the
+// port defaults to 53 and the TSIG key is optional.
+func parseSecondaryZones(v string) (map[string][]Peer, error) {
+	zones := map[string][]Peer{}
+	for _, entry := range strings.FieldsFunc(v, isListSeparator) {
+		zone, primary, ok := strings.Cut(entry, "=")
+		if !ok || zone == "" || primary == "" {
+			return nil, fmt.Errorf("entry %q is not zone=primary", entry)
+		}
+		zone = strings.ToLower(zone)
+		if !strings.HasSuffix(zone, ".") {
+			zone += "."
+		}
+		zones[zone] = append(zones[zone], ParsePeer(primary))
+	}
+	return zones, nil
+}
+
+// KeyEncryptionKey returns the passphrase that encrypts DNSSEC private key
+// files at rest, taken from DNSSEC_KEK or the file named by DNSSEC_KEK_FILE.
+// It is nil when neither is set. Read on demand so the tools, which do not
+// call LoadEnv, pick it up too.
+func KeyEncryptionKey() ([]byte, error) {
+	return secretEnv("DNSSEC_KEK")
+}
+
+// PKCS11Module is the path of the PKCS#11 library holding token keys, e.g.
+// /usr/lib/softhsm/libsofthsm2.so
+func PKCS11Module() string {
+	return os.Getenv("PKCS11_MODULE")
+}
+
+// PKCS11PIN returns the user PIN for PKCS#11 tokens, from PKCS11_PIN or the
+// file named by PKCS11_PIN_FILE
+func PKCS11PIN() (string, error) {
+	pin, err := secretEnv("PKCS11_PIN")
+	return string(pin), err
+}
+
+// secretEnv reads a secret from the environment variable name, or from the
+// file named by name_FILE with trailing newlines removed. It is nil when
+// neither is set.
+func secretEnv(name string) ([]byte, error) {
+	if v := os.Getenv(name); v != "" {
+		return []byte(v), nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+	secret := bytes.TrimRight(data, "\r\n")
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s_FILE %s is empty", name, path)
+	}
+	return secret, nil
+}
+
+func durationEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("%s must be a duration like 336h, got %q", name, v)
+	}
+	return d
 }
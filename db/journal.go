@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/miekg/dns"
+)
+
+// GetZoneDiffs returns the journaled changes of a zone from serial from
+// onwards, one ZoneDiff per version in the order they were made. It is empty
+// when the journal holds no version starting at from.
+func GetZoneDiffs(zone string, from uint32) ([]ZoneDiff, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	rows, err := conn.Query(context.Background(), `
+		SELECT j.serial_from, j.serial_to, j.op, j.name, j.type, COALESCE(j.ttl, 3600), j.data
+		FROM zone_journal j
+		JOIN zones z ON j.zone_id = z.id
+		WHERE z.name = $1 AND j.serial_to IS NOT NULL AND j.id >= (
+			SELECT min(id) FROM zone_journal
+			WHERE zone_id = z.id AND serial_from = $2
+		)
+		ORDER BY j.id
+	`, zone, int64(from))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var diffs []ZoneDiff
+	for rows.Next() {
+		var serialFrom, serialTo int64
+		var op, name, rtype, data string
+		var ttl int
+		if err := rows.Scan(&serialFrom, &serialTo, &op, &name, &rtype, &ttl, &data); err != nil {
+			return nil, err
+		}
+		rr, err := newRecord(name, ttl, rtype, data)
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(diffs)
+		if n == 0 || diffs[n-1].From != uint32(serialFrom) || diffs[n-1].To != uint32(serialTo) {
+			diffs = append(diffs, ZoneDiff{From: uint32(serialFrom), To: uint32(serialTo)})
+			n++
+		}
+		if op == "del" {
+			diffs[n-1].Deleted = append(diffs[n-1].Deleted, rr)
+		} else {
+			diffs[n-1].Added = append(diffs[n-1].Added, rr)
+		}
+	}
+	return diffs, rows.Err()
+}
+
+// PruneJournal drops journaled versions beyond the newest versions of each
+// zone and those older than maxAge. A zero limit is not applied. Changes
+// still waiting for a serial are kept.
+func PruneJournal(versions int, maxAge time.Duration) (int64, error) {
+	ctx := context.Background()
+	var pruned int64
+
+	if maxAge > 0 {
+		tag, err := conn.Exec(ctx, `
+			DELETE FROM zone_journal WHERE created_at < $1 AND serial_to IS NOT NULL
+		`, time.Now().Add(-maxAge))
+		if err != nil {
+			return pruned, err
+		}
+		pruned += tag.RowsAffected()
+	}
+
+	if versions > 0 {
+		tag, err := conn.Exec(ctx, `
+			DELETE FROM zone_journal j
+			USING (
+				SELECT zone_id, serial_from, serial_to FROM (
+					SELECT zone_id, serial_from, serial_to,
+						row_number() OVER (PARTITION BY zone_id ORDER BY max(id) DESC) AS newer
+					FROM zone_journal
+					WHERE serial_to IS NOT NULL
+					GROUP BY zone_id, serial_from, serial_to
+				) v
+				WHERE newer > $1
+			) stale
+			WHERE j.zone_id = stale.zone_id AND j.serial_from = stale.serial_from AND j.serial_to = stale.serial_to
+		`, versions)
+		if err != nil {
+			return pruned, err
+		}
+		pruned += tag.RowsAffected()
+	}
+	return pruned, nil
+}
+
+// StartJournalPruner applies the journal retention limits every interval
+func StartJournalPruner(interval time.Duration, versions int, maxAge time.Duration) {
+	go func() {
+		for {
+			if n, err := PruneJournal(versions, maxAge); err != nil {
+				log.Printf("❌ Failed to prune zone journal: %v", err)
+			} else if n > 0 {
+				log.Printf("🧹 Pruned %d journal rows", n)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// journalOff has every pooled connection turn the journal off as it opens
+var journalOff atomic.Bool
+
+// DisableJournal stops the record triggers from journaling changes made
+// through our connections. Slaves take their serials from the master, so a
+// journal kept under the serials the triggers make up would not match them.
+func DisableJournal() {
+	journalOff.Store(true)
+	// Connections opened before now reconnect with the setting
+	conn.Reset()
+}
+
+// SerialNewer compares SOA serials in sequence space arithmetic (RFC 1982)
+func SerialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// journalDiff records a difference sequence received from a primary under
+// the primary's serials
+func journalDiff(tx pgx.Tx, zoneID int, zone string, diff ZoneDiff) error {
+	ops := []struct {
+		op  string
+		rrs []dns.RR
+	}{{"del", diff.Deleted}, {"add", diff.Added}}
+	for _, o := range ops {
+		for _, rr := range o.rrs {
+			name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+			if rr.Header().Rrtype == dns.TypeSOA || coversSOA(rr) || !dns.IsSubDomain(zone, name) {
+				continue
+			}
+			data, err := recordData(rr)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(context.Background(), `
+				INSERT INTO zone_journal (zone_id, serial_from, serial_to, op, name, type, ttl, data)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			`, zoneID, int64(diff.From), int64(diff.To), o.op, name,
+				dns.TypeToString[rr.Header().Rrtype], rr.Header().Ttl, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coversSOA reports whether rr signs a SOA. SOA signatures are made for each
+// serial, so they travel with the current SOA rather than in the journal.
+func coversSOA(rr dns.RR) bool {
+	sig, ok := rr.(*dns.RRSIG)
+	return ok && sig.TypeCovered == dns.TypeSOA
+}
@@ -8,7 +8,7 @@ import (
 
 func TruncateAll() error {
 	_, err := conn.Exec(context.Background(), `
-		TRUNCATE TABLE dnssec_rrsigs, records, zones RESTART IDENTITY CASCADE;
+		TRUNCATE TABLE dnssec_rrsigs, zone_journal, records, zones RESTART IDENTITY CASCADE;
 	`)
 	return err
 }
@@ -21,6 +21,46 @@ func Migrate() {
 			ttl INT DEFAULT 3600
 		);`,
 
+		// SOA fields per zone; serial_policy is 'date' (YYYYMMDDnn) or 'counter'
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS mname TEXT,
+			ADD COLUMN IF NOT EXISTS rname TEXT,
+			ADD COLUMN IF NOT EXISTS serial BIGINT NOT NULL DEFAULT 1,
+			ADD COLUMN IF NOT EXISTS refresh INT NOT NULL DEFAULT 3600,
+			ADD COLUMN IF NOT EXISTS retry INT NOT NULL DEFAULT 900,
+			ADD COLUMN IF NOT EXISTS expire INT NOT NULL DEFAULT 1209600,
+			ADD COLUMN IF NOT EXISTS minimum INT NOT NULL DEFAULT 300,
+			ADD COLUMN IF NOT EXISTS serial_policy TEXT NOT NULL DEFAULT 'date';`,
+
+		// Authenticated denial per zone: denial is 'nsec' or 'nsec3'
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS denial TEXT NOT NULL DEFAULT 'nsec',
+			ADD COLUMN IF NOT EXISTS nsec3_salt TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS nsec3_iterations INT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS nsec3_optout BOOLEAN NOT NULL DEFAULT false;`,
+
+		// Parent signalling per zone: cds is 'publish', 'none' or 'delete'
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS cds TEXT NOT NULL DEFAULT 'publish';`,
+
+		// Signing per zone: 'presigned' stores RRSIGs in dnssec_rrsigs,
+		// 'online' signs answers on demand and keeps signatures in memory
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS signing TEXT NOT NULL DEFAULT 'presigned';`,
+
+		// Client networks allowed to AXFR each zone; empty means nobody
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS allow_transfer CIDR[] NOT NULL DEFAULT '{}';`,
+
+		// TSIG keys one of which must sign each AXFR/IXFR of the zone
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS transfer_keys TEXT[] NOT NULL DEFAULT '{}';`,
+
+		// Secondaries (host[:port][/key]) sent DNS NOTIFY for this zone on
+		// top of NOTIFY_SECONDARIES
+		`ALTER TABLE zones
+			ADD COLUMN IF NOT EXISTS also_notify TEXT[] NOT NULL DEFAULT '{}';`,
+
 		`CREATE TABLE IF NOT EXISTS records (
 			id SERIAL PRIMARY KEY,
 			zone_id INT REFERENCES zones(id) ON DELETE CASCADE,
@@ -30,7 +70,10 @@ func Migrate() {
 			data TEXT NOT NULL
 		);`,
 
-		`CREATE UNIQUE INDEX IF NOT EXISTS idx_records_unique ON records(name, type, data);`,
+		// Unique within a zone only: glue in a parent may equal a record of
+		// a child zone hosted here
+		`DROP INDEX IF EXISTS idx_records_unique;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_records_zone_unique ON records(zone_id, name, type, data);`,
 		`CREATE INDEX IF NOT EXISTS idx_records_name_type ON records(name, type);`,
 
 		`CREATE TABLE IF NOT EXISTS dnssec_rrsigs (
@@ -40,37 +83,288 @@ func Migrate() {
 			rrsig TEXT NOT NULL
 		);`,
 
-		`CREATE UNIQUE INDEX IF NOT EXISTS idx_rrsig_name_type ON dnssec_rrsigs(name, type_covered);`,
+		// NULL for signatures stored before expirations were tracked
+		`ALTER TABLE dnssec_rrsigs ADD COLUMN IF NOT EXISTS expiration TIMESTAMPTZ;`,
+		`CREATE INDEX IF NOT EXISTS idx_rrsig_expiration ON dnssec_rrsigs(expiration);`,
+
+		// One signature per RRset and key, so rollovers and algorithm changes
+		// can keep several side by side. Rows from the one-per-RRset layout
+		// carry no key and are dropped; they are re-signed on demand.
+		`ALTER TABLE dnssec_rrsigs
+			ADD COLUMN IF NOT EXISTS key_tag INT,
+			ADD COLUMN IF NOT EXISTS algorithm INT,
+			ADD COLUMN IF NOT EXISTS inception TIMESTAMPTZ;`,
+		`DROP INDEX IF EXISTS idx_rrsig_name_type;`,
+		`DELETE FROM dnssec_rrsigs WHERE key_tag IS NULL OR algorithm IS NULL;`,
+		`ALTER TABLE dnssec_rrsigs
+			ALTER COLUMN key_tag SET NOT NULL,
+			ALTER COLUMN algorithm SET NOT NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_rrsig_key ON dnssec_rrsigs(name, type_covered, key_tag, algorithm);`,
+
+		// The zone that made a stored signature: the signer name in its
+		// RDATA. A hosted child zone shares its apex name with the parent's
+		// delegation, so names alone do not tell the two apart.
+		`CREATE OR REPLACE FUNCTION rrsig_signer(rrsig TEXT)
+			RETURNS TEXT AS $$
+				SELECT lower(split_part(regexp_replace(rrsig, '^([^\t]*\t){4}', ''), ' ', 8));
+			$$ LANGUAGE sql IMMUTABLE;`,
+
+		// Every change to records, grouped by the SOA serial it led to, so
+		// IXFR can be answered with differences (RFC 1995)
+		`CREATE TABLE IF NOT EXISTS zone_journal (
+			id BIGSERIAL PRIMARY KEY,
+			zone_id INT NOT NULL REFERENCES zones(id) ON DELETE CASCADE,
+			serial_from BIGINT NOT NULL,
+			serial_to BIGINT NOT NULL,
+			op TEXT NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			ttl INT,
+			data TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_journal_zone_serial ON zone_journal(zone_id, serial_from);`,
+
+		// Signature changes wait without serials until the next serial bump
+		// of their zone takes them into its version
+		`ALTER TABLE zone_journal
+			ALTER COLUMN serial_from DROP NOT NULL,
+			ALTER COLUMN serial_to DROP NOT NULL;`,
+		`CREATE INDEX IF NOT EXISTS idx_journal_created ON zone_journal(created_at);`,
+
+		`CREATE OR REPLACE FUNCTION next_zone_serial(old BIGINT, policy TEXT)
+			RETURNS BIGINT AS $$
+			DECLARE
+				today BIGINT := to_char(now() AT TIME ZONE 'UTC', 'YYYYMMDD')::BIGINT * 100;
+			BEGIN
+				IF policy = 'date' AND today > old THEN
+					RETURN today;
+				END IF;
+				RETURN old % 4294967295 + 1;
+			END;
+			$$ LANGUAGE plpgsql;`,
+
+		// Bumps the SOA serial once per statement for every zone it touched,
+		// journaling the rows removed and added under the new serial unless
+		// dnslite.journal is off, along with the signature changes waiting
+		// for it. Updates see the old rows as replaced.
+		`CREATE OR REPLACE FUNCTION bump_zone_serial()
+			RETURNS trigger AS $$
+			BEGIN
+				IF current_setting('dnslite.journal', true) IS DISTINCT FROM 'off' THEN
+					UPDATE zone_journal j
+					SET serial_from = z.serial, serial_to = next_zone_serial(z.serial, z.serial_policy)
+					FROM zones z
+					WHERE j.zone_id = z.id AND j.serial_to IS NULL
+					AND z.id IN (SELECT zone_id FROM changed);
+					IF TG_OP = 'UPDATE' THEN
+						INSERT INTO zone_journal (zone_id, serial_from, serial_to, op, name, type, ttl, data)
+						SELECT z.id, z.serial, next_zone_serial(z.serial, z.serial_policy), 'del', r.name, r.type, r.ttl, r.data
+						FROM replaced r JOIN zones z ON z.id = r.zone_id;
+					END IF;
+					INSERT INTO zone_journal (zone_id, serial_from, serial_to, op, name, type, ttl, data)
+					SELECT z.id, z.serial, next_zone_serial(z.serial, z.serial_policy),
+						CASE WHEN TG_OP = 'DELETE' THEN 'del' ELSE 'add' END, c.name, c.type, c.ttl, c.data
+					FROM changed c JOIN zones z ON z.id = c.zone_id;
+				END IF;
+
+				UPDATE zones SET serial = next_zone_serial(serial, serial_policy)
+				WHERE id IN (SELECT DISTINCT zone_id FROM changed);
 
+				DELETE FROM dnssec_rrsigs
+				WHERE type_covered = 'SOA'
+				AND name IN (SELECT z.name FROM zones z WHERE z.id IN (SELECT zone_id FROM changed));
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;`,
+
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_serial_insert') THEN
+					CREATE TRIGGER record_serial_insert AFTER INSERT ON records REFERENCING NEW TABLE AS changed FOR EACH STATEMENT EXECUTE FUNCTION bump_zone_serial();
+				END IF;
+			END;
+		$$;`,
+
+		// Replaced by record_serial_modify, which also sees the old rows
+		`DROP TRIGGER IF EXISTS record_serial_update ON records;`,
+
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_serial_modify') THEN
+					CREATE TRIGGER record_serial_modify AFTER UPDATE ON records REFERENCING OLD TABLE AS replaced NEW TABLE AS changed FOR EACH STATEMENT EXECUTE FUNCTION bump_zone_serial();
+				END IF;
+			END;
+		$$;`,
+
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_serial_delete') THEN
+					CREATE TRIGGER record_serial_delete AFTER DELETE ON records REFERENCING OLD TABLE AS changed FOR EACH STATEMENT EXECUTE FUNCTION bump_zone_serial();
+				END IF;
+			END;
+		$$;`,
+
+		// Runs per row: drops the now-stale RRSIG of the changed RRset in the
+		// same transaction and tells listeners which name/type changed,
+		// unless dnslite.announce is off because the writer re-signs itself
 		`CREATE OR REPLACE FUNCTION notify_record_change()
 			RETURNS trigger AS $$
+			DECLARE
+				r records%ROWTYPE;
+				announce BOOLEAN := current_setting('dnslite.announce', true) IS DISTINCT FROM 'off';
 			BEGIN
-				PERFORM pg_notify('record_change', '');
+				IF TG_OP = 'DELETE' THEN
+					r := OLD;
+				ELSE
+					r := NEW;
+				END IF;
+
+				DELETE FROM dnssec_rrsigs WHERE name = r.name AND type_covered = r.type;
+				IF announce THEN
+					PERFORM pg_notify('record_change', json_build_object(
+						'name', r.name,
+						'type', r.type,
+						'zone', (SELECT name FROM zones WHERE id = r.zone_id)
+					)::text);
+				END IF;
+
+				IF TG_OP = 'UPDATE' AND (OLD.name <> NEW.name OR OLD.type <> NEW.type) THEN
+					DELETE FROM dnssec_rrsigs WHERE name = OLD.name AND type_covered = OLD.type;
+					IF announce THEN
+						PERFORM pg_notify('record_change', json_build_object(
+							'name', OLD.name,
+							'type', OLD.type,
+							'zone', (SELECT name FROM zones WHERE id = OLD.zone_id)
+						)::text);
+					END IF;
+				END IF;
 				RETURN NULL;
 			END;
 			$$ LANGUAGE plpgsql;`,
 
+		// Replaced by the row-level record_change_row trigger
+		`DROP TRIGGER IF EXISTS record_insert ON records;`,
+		`DROP TRIGGER IF EXISTS record_update ON records;`,
+		`DROP TRIGGER IF EXISTS record_delete ON records;`,
+
 		// Protect trigger creation via anonymous DO block
 		`DO $$
 			BEGIN
-				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_insert') THEN
-					CREATE TRIGGER record_insert AFTER INSERT ON records FOR EACH STATEMENT EXECUTE FUNCTION notify_record_change();
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_change_row') THEN
+					CREATE TRIGGER record_change_row AFTER INSERT OR UPDATE OR DELETE ON records FOR EACH ROW EXECUTE FUNCTION notify_record_change();
+				END IF;
+			END;
+		$$;`,
+
+		// Journals every stored signature added or removed, without serials
+		// until the next serial bump of its zone, so IXFR carries signed
+		// zones. A DS is signed by the parent. SOA signatures are made for
+		// each serial and go out with the current SOA instead. A signature
+		// removed before its addition was published cancels it.
+		`CREATE OR REPLACE FUNCTION journal_rrsig_change()
+			RETURNS trigger AS $$
+			BEGIN
+				IF current_setting('dnslite.journal', true) IS NOT DISTINCT FROM 'off' THEN
+					RETURN NULL;
+				END IF;
+
+				IF TG_OP <> 'INSERT' THEN
+					WITH removed AS (
+						SELECT z.id AS zone_id, g.name, split_part(g.rrsig, E'\t', 2)::INT AS ttl,
+							regexp_replace(g.rrsig, '^([^\t]*\t){4}', '') AS data
+						FROM gone g
+						CROSS JOIN LATERAL (
+							SELECT id FROM zones
+							WHERE (g.name = name AND g.type_covered <> 'DS') OR right(g.name, length(name) + 1) = '.' || name
+							ORDER BY length(name) DESC
+							LIMIT 1
+						) z
+						WHERE g.type_covered <> 'SOA'
+					), cancelled AS (
+						DELETE FROM zone_journal j
+						USING removed r
+						WHERE j.serial_to IS NULL AND j.op = 'add' AND j.type = 'RRSIG'
+						AND j.zone_id = r.zone_id AND j.name = r.name AND j.data = r.data
+						RETURNING j.name, j.data
+					)
+					INSERT INTO zone_journal (zone_id, op, name, type, ttl, data)
+					SELECT r.zone_id, 'del', r.name, 'RRSIG', r.ttl, r.data
+					FROM removed r
+					WHERE NOT EXISTS (SELECT 1 FROM cancelled c WHERE c.name = r.name AND c.data = r.data);
+				END IF;
+
+				IF TG_OP <> 'DELETE' THEN
+					INSERT INTO zone_journal (zone_id, op, name, type, ttl, data)
+					SELECT z.id, 'add', m.name, 'RRSIG', split_part(m.rrsig, E'\t', 2)::INT,
+						regexp_replace(m.rrsig, '^([^\t]*\t){4}', '')
+					FROM made m
+					CROSS JOIN LATERAL (
+						SELECT id FROM zones
+						WHERE (m.name = name AND m.type_covered <> 'DS') OR right(m.name, length(name) + 1) = '.' || name
+						ORDER BY length(name) DESC
+						LIMIT 1
+					) z
+					WHERE m.type_covered <> 'SOA';
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;`,
+
+		// Versions journaled before signatures were do not bring a signed
+		// copy up to date, so they go when the triggers first appear
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'rrsig_journal_insert') THEN
+					DELETE FROM zone_journal
+					WHERE zone_id IN (
+						SELECT z.id FROM zones z
+						WHERE EXISTS (SELECT 1 FROM dnssec_rrsigs s WHERE s.name = z.name)
+					);
+					CREATE TRIGGER rrsig_journal_insert AFTER INSERT ON dnssec_rrsigs REFERENCING NEW TABLE AS made FOR EACH STATEMENT EXECUTE FUNCTION journal_rrsig_change();
+				END IF;
+			END;
+		$$;`,
+
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'rrsig_journal_update') THEN
+					CREATE TRIGGER rrsig_journal_update AFTER UPDATE ON dnssec_rrsigs REFERENCING OLD TABLE AS gone NEW TABLE AS made FOR EACH STATEMENT EXECUTE FUNCTION journal_rrsig_change();
 				END IF;
 			END;
 		$$;`,
 
 		`DO $$
 			BEGIN
-				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_update') THEN
-					CREATE TRIGGER record_update AFTER UPDATE ON records FOR EACH STATEMENT EXECUTE FUNCTION notify_record_change();
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'rrsig_journal_delete') THEN
+					CREATE TRIGGER rrsig_journal_delete AFTER DELETE ON dnssec_rrsigs REFERENCING OLD TABLE AS gone FOR EACH STATEMENT EXECUTE FUNCTION journal_rrsig_change();
 				END IF;
 			END;
 		$$;`,
 
+		// Changing how a zone is signed or denies existence invalidates its
+		// cached settings and chain; the notification names the apex SOA.
+		// Versions journaled under another signing mode do not lead to the
+		// signatures now served.
+		`CREATE OR REPLACE FUNCTION notify_zone_change()
+			RETURNS trigger AS $$
+			BEGIN
+				IF NEW.signing IS DISTINCT FROM OLD.signing THEN
+					DELETE FROM zone_journal WHERE zone_id = NEW.id;
+				END IF;
+				PERFORM pg_notify('record_change', json_build_object(
+					'name', NEW.name,
+					'type', 'SOA',
+					'zone', NEW.name
+				)::text);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;`,
+
 		`DO $$
 			BEGIN
-				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'record_delete') THEN
-					CREATE TRIGGER record_delete AFTER DELETE ON records FOR EACH STATEMENT EXECUTE FUNCTION notify_record_change();
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'zone_settings_change') THEN
+					CREATE TRIGGER zone_settings_change AFTER UPDATE OF signing, denial, nsec3_salt, nsec3_iterations, nsec3_optout, cds ON zones FOR EACH ROW EXECUTE FUNCTION notify_zone_change();
 				END IF;
 			END;
 		$$;`,
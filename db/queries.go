@@ -5,24 +5,42 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/netip"
 	"strings"
+	"time"
+
+	"dnslite/dnssec"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/miekg/dns"
 )
 
-var conn *pgx.Conn
+// conn is a pool, so a long transaction such as a zone transfer runs on a
+// connection of its own while queries carry on beside it
+var conn *pgxpool.Pool
 
 func Connect(url string) {
-	var err error
-	conn, err = pgx.Connect(context.Background(), url)
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		log.Fatal("DB connection failed:", err)
+	}
+	config.AfterConnect = func(ctx context.Context, c *pgx.Conn) error {
+		if journalOff.Load() {
+			_, err := c.Exec(ctx, `SET dnslite.journal = 'off'`)
+			return err
+		}
+		return nil
+	}
+	conn, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		log.Fatal("DB connection failed:", err)
 	}
 }
 
 func Close() {
-	conn.Close(context.Background())
+	conn.Close()
 }
 
 // QueryRecords returns all RRs of a name/qtype
@@ -46,10 +64,9 @@ func QueryRecords(name string, qtype uint16) ([]dns.RR, error) {
 			continue
 		}
 
-		rrStr := fmt.Sprintf("%s %d IN %s %s", name, ttl, rtype, data)
-		rr, err := dns.NewRR(rrStr)
+		rr, err := newRecord(name, ttl, rtype, data)
 		if err != nil {
-			log.Println("Failed to parse RR:", rrStr, err)
+			log.Println("Failed to parse RR:", err)
 			continue
 		}
 		results = append(results, rr)
@@ -57,36 +74,133 @@ func QueryRecords(name string, qtype uint16) ([]dns.RR, error) {
 	return results, nil
 }
 
-// QueryRRSIG returns a single matching RRSIG
-func QueryRRSIG(name string, qtype uint16) (dns.RR, error) {
+// newRecord builds an RR from the columns of a records row
+func newRecord(name string, ttl int, rtype, data string) (dns.RR, error) {
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, rtype, data))
+}
+
+// QueryRRSIGs returns every stored RRSIG of an RRset, one per signing key.
+// Expired signatures are included; callers check the validity period.
+func QueryRRSIGs(name string, qtype uint16) ([]dns.RR, error) {
 	name = dns.Fqdn(strings.ToLower(name))
 
-	row := conn.QueryRow(context.Background(), `
+	rows, err := conn.Query(context.Background(), `
 		SELECT rrsig FROM dnssec_rrsigs
 		WHERE name = $1 AND type_covered = $2
+		ORDER BY algorithm, key_tag
 	`, name, dns.TypeToString[qtype])
-
-	var rrsigStr string
-	if err := row.Scan(&rrsigStr); err != nil {
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return dns.NewRR(rrsigStr)
+	var results []dns.RR
+	for rows.Next() {
+		var rrsigStr string
+		if err := rows.Scan(&rrsigStr); err != nil {
+			continue
+		}
+		rr, err := dns.NewRR(rrsigStr)
+		if err != nil {
+			log.Println("Failed to parse RRSIG:", rrsigStr, err)
+			continue
+		}
+		results = append(results, rr)
+	}
+	return results, rows.Err()
 }
 
-// StoreRRSIG inserts or updates an RRSIG
+// StoreRRSIG inserts or replaces the signature of an RRset made by the key
+// named in rrsig, leaving signatures by other keys in place
 func StoreRRSIG(name string, qtype uint16, rrsig dns.RR) error {
+	return storeRRSIG(conn, name, qtype, rrsig)
+}
+
+// ReplaceRRSIGs swaps all stored signatures of an RRset for sigs in one
+// transaction
+func ReplaceRRSIGs(name string, qtype uint16, sigs []dns.RR) error {
 	name = dns.Fqdn(strings.ToLower(name))
 
-	_, err := conn.Exec(context.Background(), `
-		INSERT INTO dnssec_rrsigs (name, type_covered, rrsig)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (name, type_covered) DO UPDATE SET rrsig = EXCLUDED.rrsig
-	`, name, dns.TypeToString[qtype], rrsig.String())
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM dnssec_rrsigs WHERE name = $1 AND type_covered = $2
+	`, name, dns.TypeToString[qtype]); err != nil {
+		return err
+	}
+	for _, sig := range sigs {
+		if err := storeRRSIG(tx, name, qtype, sig); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func storeRRSIG(q querier, name string, qtype uint16, rrsig dns.RR) error {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	sig, ok := rrsig.(*dns.RRSIG)
+	if !ok {
+		return fmt.Errorf("not an RRSIG: %s", rrsig)
+	}
+
+	_, err := q.Exec(context.Background(), `
+		INSERT INTO dnssec_rrsigs (name, type_covered, key_tag, algorithm, inception, expiration, rrsig)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (name, type_covered, key_tag, algorithm) DO UPDATE
+		SET rrsig = EXCLUDED.rrsig, inception = EXCLUDED.inception, expiration = EXCLUDED.expiration
+	`, name, dns.TypeToString[qtype], int(sig.KeyTag), int(sig.Algorithm),
+		time.Unix(int64(sig.Inception), 0), time.Unix(int64(sig.Expiration), 0), sig.String())
+
+	return err
+}
+
+// querier is what the write helpers need from either the pool or a
+// transaction
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// DeleteRRSIG removes the stored signature of an RRset
+func DeleteRRSIG(name string, qtype uint16) error {
+	name = dns.Fqdn(strings.ToLower(name))
 
+	_, err := conn.Exec(context.Background(), `
+		DELETE FROM dnssec_rrsigs WHERE name = $1 AND type_covered = $2
+	`, name, dns.TypeToString[qtype])
 	return err
 }
 
+// GetExpiringRRSIGs returns the RRsets with a stored signature that expires
+// before the given time, or whose expiration is unknown
+func GetExpiringRRSIGs(before time.Time) ([]RRSetKey, error) {
+	rows, err := conn.Query(context.Background(), `
+		SELECT name, type_covered FROM dnssec_rrsigs
+		WHERE expiration IS NULL OR expiration < $1
+		GROUP BY name, type_covered
+		ORDER BY min(expiration) NULLS FIRST
+	`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []RRSetKey
+	for rows.Next() {
+		var name, typeStr string
+		if err := rows.Scan(&name, &typeStr); err != nil {
+			continue
+		}
+		keys = append(keys, RRSetKey{Name: name, Type: dns.StringToType[typeStr]})
+	}
+	return keys, rows.Err()
+}
+
 // InsertZone adds or gets a zone ID
 func InsertZone(name string) (int, error) {
 	name = dns.Fqdn(strings.ToLower(name))
@@ -101,6 +215,365 @@ func InsertZone(name string) (int, error) {
 	return id, err
 }
 
+// FindZone returns the most specific zone in the zones table that contains
+// name, matched on label boundaries, or "" if no zone does
+func FindZone(name string) (string, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	var zone string
+	err := conn.QueryRow(context.Background(), `
+		SELECT name FROM zones
+		WHERE $1 = name OR right($1, length(name) + 1) = '.' || name
+		ORDER BY length(name) DESC
+		LIMIT 1
+	`, name).Scan(&zone)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return zone, err
+}
+
+// FindZoneCut returns the topmost delegation point (a non-apex owner of NS
+// records in zone) at or above name, or "" if name is not delegated
+func FindZoneCut(name, zone string) (string, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var cut string
+	err := conn.QueryRow(context.Background(), `
+		SELECT r.name FROM records r
+		JOIN zones z ON r.zone_id = z.id
+		WHERE z.name = $2 AND r.type = 'NS' AND r.name <> z.name
+		AND ($1 = r.name OR right($1, length(r.name) + 1) = '.' || r.name)
+		ORDER BY length(r.name)
+		LIMIT 1
+	`, name, zone).Scan(&cut)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return cut, err
+}
+
+// NameExists reports whether name owns any record or is an empty non-terminal.
+// NSEC3 owners are hashes, not names of the zone (RFC 5155 section 7.2.8).
+func NameExists(name string) (bool, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	var exists bool
+	err := conn.QueryRow(context.Background(), `
+		SELECT EXISTS (
+			SELECT 1 FROM records
+			WHERE (name = $1 OR right(name, length($1) + 1) = '.' || $1)
+			AND type <> 'NSEC3'
+		)
+	`, name).Scan(&exists)
+	return exists, err
+}
+
+// QuerySOA builds the SOA record for a zone from its zones row
+func QuerySOA(zone string) (*dns.SOA, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var mname, rname string
+	var ttl, refresh, retry, expire, minimum int
+	var serial int64
+	err := conn.QueryRow(context.Background(), `
+		SELECT COALESCE(ttl, 3600), COALESCE(mname, name), COALESCE(rname, 'hostmaster.' || name),
+			serial, refresh, retry, expire, minimum
+		FROM zones WHERE name = $1
+	`, zone).Scan(&ttl, &mname, &rname, &serial, &refresh, &retry, &expire, &minimum)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttl),
+		},
+		Ns:      dns.Fqdn(mname),
+		Mbox:    dns.Fqdn(rname),
+		Serial:  uint32(serial),
+		Refresh: uint32(refresh),
+		Retry:   uint32(retry),
+		Expire:  uint32(expire),
+		Minttl:  uint32(minimum),
+	}, nil
+}
+
+// BumpSerial moves the serial of a zone on by its serial policy, for changes
+// the record triggers do not see, such as new signatures. The journaled
+// signature changes waiting for a serial become the new version, and the SOA
+// signatures go with the old serial.
+func BumpSerial(zone string) error {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	_, err := conn.Exec(context.Background(), `
+		WITH old AS (
+			SELECT id, name, serial FROM zones WHERE name = $1 FOR UPDATE
+		), bumped AS (
+			UPDATE zones z SET serial = next_zone_serial(z.serial, z.serial_policy)
+			FROM old
+			WHERE z.id = old.id
+			RETURNING z.id, z.name, old.serial AS serial_from, z.serial AS serial_to
+		), claimed AS (
+			UPDATE zone_journal j SET serial_from = b.serial_from, serial_to = b.serial_to
+			FROM bumped b
+			WHERE j.zone_id = b.id AND j.serial_to IS NULL
+		)
+		DELETE FROM dnssec_rrsigs
+		WHERE type_covered = 'SOA' AND name IN (SELECT name FROM bumped)
+	`, zone)
+	return err
+}
+
+// GetDenialConfig returns the NSEC/NSEC3 settings of a zone
+func GetDenialConfig(zone string) (dnssec.DenialConfig, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var cfg dnssec.DenialConfig
+	var denial string
+	var iterations int
+	err := conn.QueryRow(context.Background(), `
+		SELECT denial, nsec3_salt, nsec3_iterations, nsec3_optout
+		FROM zones WHERE name = $1
+	`, zone).Scan(&denial, &cfg.Salt, &iterations, &cfg.OptOut)
+	cfg.NSEC3 = denial == "nsec3"
+	cfg.Iterations = uint16(iterations)
+	return cfg, err
+}
+
+// GetCDSMode returns how the zone signals its DS to the parent: one of
+// dnssec.CDSPublish, dnssec.CDSNone or dnssec.CDSDelete
+func GetCDSMode(zone string) (string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var mode string
+	err := conn.QueryRow(context.Background(), `
+		SELECT cds FROM zones WHERE name = $1
+	`, zone).Scan(&mode)
+	return mode, err
+}
+
+// GetSigningMode returns "presigned" or "online" for a zone
+func GetSigningMode(zone string) (string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var mode string
+	err := conn.QueryRow(context.Background(), `
+		SELECT signing FROM zones WHERE name = $1
+	`, zone).Scan(&mode)
+	return mode, err
+}
+
+// GetTransferACL returns the client networks allowed to transfer a zone and
+// the TSIG keys allowed to sign transfer requests
+func GetTransferACL(zone string) ([]netip.Prefix, []string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var nets, keys []string
+	err := conn.QueryRow(context.Background(), `
+		SELECT allow_transfer::text[], transfer_keys FROM zones WHERE name = $1
+	`, zone).Scan(&nets, &keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acl := make([]netip.Prefix, 0, len(nets))
+	for _, n := range nets {
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid allow_transfer entry %q: %w", n, err)
+		}
+		acl = append(acl, prefix)
+	}
+	for i, key := range keys {
+		keys[i] = dns.CanonicalName(key)
+	}
+	return acl, keys, nil
+}
+
+// GetAlsoNotify returns the secondaries configured to be notified of
+// changes to a zone
+func GetAlsoNotify(zone string) ([]string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	var targets []string
+	err := conn.QueryRow(context.Background(), `
+		SELECT also_notify FROM zones WHERE name = $1
+	`, zone).Scan(&targets)
+	return targets, err
+}
+
+// GetZoneTypes maps every owner name stored in a zone to its RR types
+func GetZoneTypes(zone string) (map[string][]uint16, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	rows, err := conn.Query(context.Background(), `
+		SELECT DISTINCT r.name, r.type FROM records r
+		JOIN zones z ON r.zone_id = z.id
+		WHERE z.name = $1
+	`, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := map[string][]uint16{}
+	for rows.Next() {
+		var name, typeStr string
+		if err := rows.Scan(&name, &typeStr); err != nil {
+			continue
+		}
+		types[name] = append(types[name], dns.StringToType[typeStr])
+	}
+	return types, rows.Err()
+}
+
+// QueryZoneRecords returns every record of the given types in a zone,
+// whatever their owner
+func QueryZoneRecords(zone string, types ...uint16) ([]dns.RR, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	rows, err := conn.Query(context.Background(), `
+		SELECT r.name, r.type, r.ttl, r.data FROM records r
+		JOIN zones z ON r.zone_id = z.id
+		WHERE z.name = $1 AND r.type = ANY($2)
+	`, zone, typeNames(types))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []dns.RR
+	for rows.Next() {
+		var name, rtype, data string
+		var ttl int
+		if err := rows.Scan(&name, &rtype, &ttl, &data); err != nil {
+			return nil, err
+		}
+		rr, err := newRecord(name, ttl, rtype, data)
+		if err != nil {
+			log.Println("Failed to parse RR:", err)
+			continue
+		}
+		results = append(results, rr)
+	}
+	return results, rows.Err()
+}
+
+// SyncRecords makes the records of the given types in zone match want in one
+// transaction, writing only the rows that differ, and returns the RRsets it
+// changed. The record triggers drop their signatures as usual but announce
+// nothing: the caller re-signs what it wrote itself.
+func SyncRecords(zone string, types []uint16, want []dns.RR) ([]RRSetKey, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var zoneID int
+	if err := tx.QueryRow(ctx, `SELECT id FROM zones WHERE name = $1`, zone).Scan(&zoneID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `SET LOCAL dnslite.announce = 'off'`); err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		id  int
+		ttl int
+	}
+	have := map[[3]string]row{}
+	rows, err := tx.Query(ctx, `
+		SELECT id, name, type, ttl, data FROM records
+		WHERE zone_id = $1 AND type = ANY($2)
+	`, zoneID, typeNames(types))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var r row
+		var name, rtype, data string
+		if err := rows.Scan(&r.id, &name, &rtype, &r.ttl, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		have[[3]string{name, rtype, data}] = r
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	changed := map[RRSetKey]bool{}
+	var names, rtypes, datas []string
+	var ttls []int
+	for _, rr := range want {
+		name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+		rtype := dns.TypeToString[rr.Header().Rrtype]
+		data, err := recordData(rr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rr, err)
+		}
+		ttl := int(rr.Header().Ttl)
+		key := [3]string{name, rtype, data}
+		if r, ok := have[key]; ok {
+			delete(have, key)
+			if r.ttl == ttl {
+				continue
+			}
+		}
+		names, rtypes, ttls, datas = append(names, name), append(rtypes, rtype), append(ttls, ttl), append(datas, data)
+		changed[RRSetKey{Name: name, Type: rr.Header().Rrtype}] = true
+	}
+	var stale []int
+	for key, r := range have {
+		stale = append(stale, r.id)
+		changed[RRSetKey{Name: key[0], Type: dns.StringToType[key[1]]}] = true
+	}
+
+	// One statement each, so the serial moves once rather than per row
+	if len(stale) > 0 {
+		if _, err := tx.Exec(ctx, `DELETE FROM records WHERE id = ANY($1)`, stale); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) > 0 {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO records (zone_id, name, type, ttl, data)
+			SELECT $1::int, * FROM unnest($2::text[], $3::text[], $4::int[], $5::text[])
+			ON CONFLICT (zone_id, name, type, data) DO UPDATE SET ttl = EXCLUDED.ttl
+			WHERE records.ttl IS DISTINCT FROM EXCLUDED.ttl
+		`, zoneID, names, rtypes, ttls, datas); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	keys := make([]RRSetKey, 0, len(changed))
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func typeNames(types []uint16) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = dns.TypeToString[t]
+	}
+	return names
+}
+
 func GetRRSetKeysForZone(zone string) ([]RRSetKey, error) {
 	normalized := dns.Fqdn(strings.ToLower(zone))
 	log.Printf("🔍 Querying RRSetKeys for zone: '%s'\n", normalized)
@@ -141,59 +614,70 @@ func GetRRSetKeysForZone(zone string) ([]RRSetKey, error) {
 func UpsertRecord(name string, qtype uint16, rr dns.RR) error {
 	name = dns.Fqdn(strings.ToLower(name))
 
-	// 1. Try to find the correct zone for this record
+	// 1. Find the most specific zone holding this record
+	zone, err := FindZone(name)
+	if err == nil && zone == "" {
+		err = fmt.Errorf("no zone contains %s", name)
+	}
 	var zoneID int
-	err := conn.QueryRow(context.Background(), `
-		SELECT id FROM zones
-		WHERE $1 LIKE '%' || name
-		AND position(name in $1) > 0
-	`, name).Scan(&zoneID)
-
+	if err == nil {
+		err = conn.QueryRow(context.Background(), `SELECT id FROM zones WHERE name = $1`, zone).Scan(&zoneID)
+	}
 	if err != nil {
 		log.Printf("❌ Could not find zone for record %s: %v", name, err)
 		return err
 	}
 
 	// 2. Prepare data depending on type
-	var data string
+	data, err := recordData(rr)
+	if err != nil {
+		log.Printf("⚠️ Could not parse data for record: %s", rr.String())
+		return err
+	}
+
+	// 3. Debug log the record to be inserted
+	log.Printf("➡️ Inserting RR: name=%s type=%s ttl=%d data=%s", name, dns.TypeToString[qtype], rr.Header().Ttl, data)
+
+	// 4. Insert the record
+	err = insertRecord(conn, zoneID, name, qtype, rr.Header().Ttl, data)
+	if err != nil {
+		log.Printf("❌ Failed to insert RR %s: %v", name, err)
+	}
+	return err
+}
+
+// recordData renders the RDATA of rr the way the data column stores it
+func recordData(rr dns.RR) (string, error) {
 	switch r := rr.(type) {
 	case *dns.A:
-		data = r.A.String()
+		return r.A.String(), nil
 	case *dns.AAAA:
-		data = r.AAAA.String()
+		return r.AAAA.String(), nil
 	case *dns.CNAME:
-		data = r.Target
+		return r.Target, nil
 	case *dns.MX:
-		data = fmt.Sprintf("%d %s", r.Preference, r.Mx)
+		return fmt.Sprintf("%d %s", r.Preference, r.Mx), nil
 	case *dns.TXT:
-		data = strings.Join(r.Txt, " ")
+		return strings.Join(r.Txt, " "), nil
 	case *dns.NS:
-		data = r.Ns
+		return r.Ns, nil
 	case *dns.DNSKEY:
-		data = fmt.Sprintf("%d %d %d %s", r.Flags, r.Protocol, r.Algorithm, r.PublicKey)
-	default:
-		parts := strings.Fields(rr.String())
-		if len(parts) >= 5 {
-			data = strings.Join(parts[4:], " ")
-		} else {
-			log.Printf("⚠️ Could not parse data for record: %s", rr.String())
-			return fmt.Errorf("unhandled RR format")
-		}
+		return fmt.Sprintf("%d %d %d %s", r.Flags, r.Protocol, r.Algorithm, r.PublicKey), nil
 	}
+	parts := strings.Fields(rr.String())
+	if len(parts) < 5 {
+		return "", fmt.Errorf("unhandled RR format")
+	}
+	return strings.Join(parts[4:], " "), nil
+}
 
-	// 3. Debug log the record to be inserted
-	log.Printf("➡️ Inserting RR: name=%s type=%s ttl=%d data=%s", name, dns.TypeToString[qtype], rr.Header().Ttl, data)
-
-	// 4. Insert the record
-	_, err = conn.Exec(context.Background(), `
+func insertRecord(q querier, zoneID int, name string, qtype uint16, ttl uint32, data string) error {
+	_, err := q.Exec(context.Background(), `
 		INSERT INTO records (zone_id, name, type, ttl, data)
 		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (name, type, data) DO UPDATE SET ttl = EXCLUDED.ttl
-	`, zoneID, name, dns.TypeToString[qtype], rr.Header().Ttl, data)
-
-	if err != nil {
-		log.Printf("❌ Failed to insert RR %s: %v", name, err)
-	}
+		ON CONFLICT (zone_id, name, type, data) DO UPDATE SET ttl = EXCLUDED.ttl
+		WHERE records.ttl IS DISTINCT FROM EXCLUDED.ttl
+	`, zoneID, name, dns.TypeToString[qtype], ttl, data)
 	return err
 }
 
@@ -224,6 +708,26 @@ func GetAllZoneNames() ([]string, error) {
 	return zones, nil
 }
 
+// GetZoneSerials returns the SOA serial of every zone
+func GetZoneSerials() (map[string]uint32, error) {
+	rows, err := conn.Query(context.Background(), `SELECT name, serial FROM zones`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	serials := map[string]uint32{}
+	for rows.Next() {
+		var name string
+		var serial int64
+		if err := rows.Scan(&name, &serial); err != nil {
+			return nil, err
+		}
+		serials[name] = uint32(serial)
+	}
+	return serials, rows.Err()
+}
+
 func DeleteAllRecordsForZoneID(zoneID int) error {
 	// Delete RRSIGs first
 	_, err := conn.Exec(context.Background(), `
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/miekg/dns"
+)
+
+// ZoneDiff is one IXFR difference sequence (RFC 1995 section 4): the records
+// removed and added to go from serial From to serial To
+type ZoneDiff struct {
+	From    uint32
+	To      uint32
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// ReplaceZone swaps the whole contents of a zone for records, as received by
+// AXFR, in one transaction. records holds everything but the SOA, RRSIGs
+// included; the zone is created if needed and its SOA set to soa.
+func ReplaceZone(zone string, soa *dns.SOA, records []dns.RR) error {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var zoneID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO zones (name)
+		VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+	`, zone).Scan(&zoneID)
+	if err != nil {
+		return err
+	}
+
+	// The old history does not lead to the new copy
+	if _, err := tx.Exec(ctx, `SET LOCAL dnslite.journal = 'off'`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM zone_journal WHERE zone_id = $1`, zoneID); err != nil {
+		return err
+	}
+	if err := deleteZoneRRSIGs(tx, zone); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM records WHERE zone_id = $1`, zoneID); err != nil {
+		return err
+	}
+
+	var sigs []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			sigs = append(sigs, rr)
+			continue
+		}
+		if err := addRecord(tx, zoneID, zone, rr); err != nil {
+			return err
+		}
+	}
+
+	// Record triggers drop the signatures of changed RRsets and the SOA, so
+	// signatures go in once all records and the serial are in place
+	if err := updateSOA(tx, zone, soa); err != nil {
+		return err
+	}
+	for _, sig := range sigs {
+		if err := addRRSIG(tx, zone, sig); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ApplyZoneDiffs applies IXFR difference sequences to a zone in order and
+// journals them, then sets its SOA to soa, in one transaction. The SOA
+// signatures added by the last difference replace the stored ones.
+func ApplyZoneDiffs(zone string, soa *dns.SOA, diffs []ZoneDiff) error {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var zoneID int
+	if err := tx.QueryRow(ctx, `SELECT id FROM zones WHERE name = $1`, zone).Scan(&zoneID); err != nil {
+		return err
+	}
+
+	// Journaled under the primary's serials rather than by the triggers, so
+	// IXFR can be passed on unchanged
+	if _, err := tx.Exec(ctx, `SET LOCAL dnslite.journal = 'off'`); err != nil {
+		return err
+	}
+	var soaSigs []dns.RR
+	for _, diff := range diffs {
+		if err := journalDiff(tx, zoneID, zone, diff); err != nil {
+			return err
+		}
+
+		var deletedSigs, addedSigs []dns.RR
+		soaSigs = nil
+		for _, rr := range diff.Deleted {
+			if coversSOA(rr) {
+				continue
+			}
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				deletedSigs = append(deletedSigs, rr)
+				continue
+			}
+			if err := deleteRecord(tx, zoneID, zone, rr); err != nil {
+				return err
+			}
+		}
+		for _, rr := range diff.Added {
+			if coversSOA(rr) {
+				soaSigs = append(soaSigs, rr)
+				continue
+			}
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				addedSigs = append(addedSigs, rr)
+				continue
+			}
+			if err := addRecord(tx, zoneID, zone, rr); err != nil {
+				return err
+			}
+		}
+		for _, rr := range deletedSigs {
+			if err := deleteRRSIG(tx, rr); err != nil {
+				return err
+			}
+		}
+		for _, rr := range addedSigs {
+			if err := addRRSIG(tx, zone, rr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := updateSOA(tx, zone, soa); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM dnssec_rrsigs WHERE name = $1 AND type_covered = 'SOA'
+	`, zone); err != nil {
+		return err
+	}
+	for _, rr := range soaSigs {
+		if err := addRRSIG(tx, zone, rr); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteZone removes a zone with all its records and signatures, so it is
+// no longer answered for
+func DeleteZone(zone string) error {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := deleteZoneRRSIGs(tx, zone); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM records WHERE zone_id = (SELECT id FROM zones WHERE name = $1)
+	`, zone); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM zones WHERE name = $1`, zone); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// deleteZoneRRSIGs removes the signatures zone made. Those of a child zone
+// hosted here, which share names below and at its apex, stay.
+func deleteZoneRRSIGs(tx pgx.Tx, zone string) error {
+	_, err := tx.Exec(context.Background(), `
+		DELETE FROM dnssec_rrsigs
+		WHERE (name = $1 OR right(name, length($1) + 1) = '.' || $1)
+		AND rrsig_signer(rrsig) = $1
+	`, zone)
+	return err
+}
+
+// addRecord inserts a transferred record. The SOA lives in the zones row and
+// records outside the zone are ignored.
+func addRecord(tx pgx.Tx, zoneID int, zone string, rr dns.RR) error {
+	name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+	qtype := rr.Header().Rrtype
+	if qtype == dns.TypeSOA {
+		return nil
+	}
+	if !dns.IsSubDomain(zone, name) {
+		log.Printf("⚠️ Ignoring out-of-zone record in %s: %s", zone, rr)
+		return nil
+	}
+	data, err := recordData(rr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rr, err)
+	}
+	return insertRecord(tx, zoneID, name, qtype, rr.Header().Ttl, data)
+}
+
+func deleteRecord(tx pgx.Tx, zoneID int, zone string, rr dns.RR) error {
+	name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+	qtype := rr.Header().Rrtype
+	if qtype == dns.TypeSOA || !dns.IsSubDomain(zone, name) {
+		return nil
+	}
+	data, err := recordData(rr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rr, err)
+	}
+	_, err = tx.Exec(context.Background(), `
+		DELETE FROM records
+		WHERE zone_id = $1 AND name = $2 AND type = $3 AND data = $4
+	`, zoneID, name, dns.TypeToString[qtype], data)
+	return err
+}
+
+func addRRSIG(tx pgx.Tx, zone string, rr dns.RR) error {
+	if !dns.IsSubDomain(zone, dns.Fqdn(strings.ToLower(rr.Header().Name))) {
+		return nil
+	}
+	return storeRRSIG(tx, rr.Header().Name, rr.(*dns.RRSIG).TypeCovered, rr)
+}
+
+func deleteRRSIG(tx pgx.Tx, rr dns.RR) error {
+	sig := rr.(*dns.RRSIG)
+	_, err := tx.Exec(context.Background(), `
+		DELETE FROM dnssec_rrsigs
+		WHERE name = $1 AND type_covered = $2 AND key_tag = $3 AND algorithm = $4
+	`, dns.Fqdn(strings.ToLower(sig.Hdr.Name)), dns.TypeToString[sig.TypeCovered],
+		int(sig.KeyTag), int(sig.Algorithm))
+	return err
+}
+
+func updateSOA(q querier, zone string, soa *dns.SOA) error {
+	_, err := q.Exec(context.Background(), `
+		UPDATE zones
+		SET ttl = $2, mname = $3, rname = $4, serial = $5,
+			refresh = $6, retry = $7, expire = $8, minimum = $9
+		WHERE name = $1
+	`, zone, soa.Hdr.Ttl, soa.Ns, soa.Mbox, int64(soa.Serial),
+		soa.Refresh, soa.Retry, soa.Expire, soa.Minttl)
+	return err
+}
@@ -2,16 +2,61 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/jackc/pgconn"
+	"github.com/miekg/dns"
 	"dnslite/cache"
 )
 
-// WatchForChanges listens for PostgreSQL NOTIFY on "record_change" and clears cache when triggered
-func WatchForChanges() {
+// RecordChange is the payload of a "record_change" notification: the RRset
+// that was added to, changed or removed from a zone
+type RecordChange struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Zone string `json:"zone"`
+}
+
+// Qtype returns the RR type of the changed RRset
+func (c RecordChange) Qtype() uint16 {
+	return dns.StringToType[c.Type]
+}
+
+// WatchForChanges listens for PostgreSQL NOTIFY on "record_change", drops the
+// cached RRset and zone data it touches and passes it on to onChange
+// (which may be nil). It reconnects if the listening connection drops.
+func WatchForChanges(onChange func(RecordChange)) {
+	for {
+		watch(onChange)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func watch(onChange func(RecordChange)) {
+	config, err := pgconn.ParseConfig(conn.Config().ConnString())
+	if err != nil {
+		log.Printf("❌ Failed to parse DB config for NOTIFY: %v", err)
+		return
+	}
+	config.OnNotification = func(_ *pgconn.PgConn, n *pgconn.Notification) {
+		var change RecordChange
+		if err := json.Unmarshal([]byte(n.Payload), &change); err != nil || change.Name == "" {
+			log.Println("🔁 Detected DB change via NOTIFY — clearing cache")
+			cache.Clear()
+			return
+		}
+
+		cache.Delete(change.Name, change.Qtype())
+		cache.DeleteZone(change.Zone)
+		if onChange != nil {
+			onChange(change)
+		}
+	}
+
 	// Connect a separate raw connection for LISTEN
-	connRaw, err := pgconn.Connect(context.Background(), conn.Config().ConnString())
+	connRaw, err := pgconn.ConnectConfig(context.Background(), config)
 	if err != nil {
 		log.Printf("❌ Failed to connect for NOTIFY: %v", err)
 		return
@@ -26,10 +71,13 @@ func WatchForChanges() {
 
 	log.Println("📡 Listening for DB changes to invalidate cache...")
 
+	// Anything cached before LISTEN took effect may already be stale
+	cache.Clear()
+
 	for {
-		notification := connRaw.WaitForNotification(context.Background())
-		log.Println("🔁 Detected DB change via NOTIFY — clearing cache")
-		cache.Clear()
-		_ = notification // you can log this if desired
+		if err := connRaw.WaitForNotification(context.Background()); err != nil {
+			log.Printf("❌ Lost NOTIFY connection: %v", err)
+			return
+		}
 	}
 }
@@ -0,0 +1,304 @@
+package dnssec
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DenialConfig selects how a zone proves non-existence
+type DenialConfig struct {
+	NSEC3      bool
+	Salt       string // hex, "" for none
+	Iterations uint16
+	OptOut     bool // leave unsigned delegations out of the NSEC3 chain
+}
+
+// Chain is the NSEC or NSEC3 chain of a signed zone, built from the set of
+// owner names and their types. Signatures are created lazily and kept until
+// they come within the refresh window of expiring; the chain itself is
+// rebuilt whenever the zone changes.
+type Chain struct {
+	Zone   string
+	Config DenialConfig
+
+	owners []string // canonical order (NSEC) or hash order (NSEC3)
+	byKey  map[string]dns.RR
+	param  *dns.NSEC3PARAM
+	sigs   sync.Map
+}
+
+// BuildChain creates the denial chain for zone. types maps every owner name
+// of the zone to the RR types it holds. Delegation points keep only NS and
+// DS and the glue below them is left out; delegations without DS are what
+// NSEC3 opt-out skips.
+func BuildChain(zone string, types map[string][]uint16, cfg DenialConfig, ttl uint32) *Chain {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	c := &Chain{Zone: zone, Config: cfg, byKey: map[string]dns.RR{}}
+	types, insecure := authoritative(zone, types)
+
+	if !cfg.NSEC3 {
+		for name := range types {
+			c.owners = append(c.owners, name)
+		}
+		sort.Slice(c.owners, func(i, j int) bool {
+			return CanonicalLess(c.owners[i], c.owners[j])
+		})
+		for i, name := range c.owners {
+			bitmap := append([]uint16{dns.TypeNSEC, dns.TypeRRSIG}, types[name]...)
+			c.byKey[name] = &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+				NextDomain: c.owners[(i+1)%len(c.owners)],
+				TypeBitMap: sortedTypes(bitmap),
+			}
+		}
+		return c
+	}
+
+	c.param = &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		Iterations: cfg.Iterations,
+		SaltLength: uint8(len(cfg.Salt) / 2),
+		Salt:       cfg.Salt,
+	}
+
+	// Empty non-terminals get NSEC3 records too (RFC 5155 section 7.1)
+	hashed := map[string][]uint16{}
+	for name, t := range types {
+		if cfg.OptOut && insecure[name] {
+			continue
+		}
+		hashed[name] = t
+		for parent := ParentName(name); parent != "" && dns.IsSubDomain(zone, parent); parent = ParentName(parent) {
+			if _, ok := hashed[parent]; !ok {
+				if _, ok := types[parent]; !ok {
+					hashed[parent] = nil
+				}
+			}
+		}
+	}
+
+	flags := uint8(0)
+	if cfg.OptOut {
+		flags = 1
+	}
+	hashes := map[string][]uint16{}
+	for name, t := range hashed {
+		if len(t) > 0 && !insecure[name] {
+			t = append([]uint16{dns.TypeRRSIG}, t...)
+		}
+		hashes[dns.HashName(name, dns.SHA1, cfg.Iterations, cfg.Salt)] = t
+	}
+	for h := range hashes {
+		c.owners = append(c.owners, h)
+	}
+	sort.Strings(c.owners)
+	for i, h := range c.owners {
+		c.byKey[h] = &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: cfg.Iterations,
+			SaltLength: uint8(len(cfg.Salt) / 2),
+			Salt:       cfg.Salt,
+			HashLength: 20,
+			NextDomain: c.owners[(i+1)%len(c.owners)],
+			TypeBitMap: sortedTypes(hashes[h]),
+		}
+	}
+	return c
+}
+
+// LoadChain rebuilds the chain of zone from its stored NSEC or NSEC3 records
+// and NSEC3PARAM, as a server without the zone's keys receives them. The
+// chain is empty when there are none; its signatures are stored beside it.
+func LoadChain(zone string, records []dns.RR) *Chain {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	c := &Chain{Zone: zone, byKey: map[string]dns.RR{}}
+
+	nsec, nsec3 := map[string]dns.RR{}, map[string]dns.RR{}
+	for _, rr := range records {
+		switch r := rr.(type) {
+		case *dns.NSEC3PARAM:
+			if dns.CanonicalName(r.Hdr.Name) == zone {
+				c.param = r
+			}
+		case *dns.NSEC3:
+			label := dns.SplitDomainName(r.Hdr.Name)[0]
+			nsec3[strings.ToUpper(label)] = r
+			c.Config = DenialConfig{NSEC3: true, Salt: r.Salt, Iterations: r.Iterations, OptOut: r.Flags&1 == 1}
+		case *dns.NSEC:
+			nsec[dns.CanonicalName(r.Hdr.Name)] = r
+		}
+	}
+
+	if c.param != nil || len(nsec) == 0 {
+		if !c.Config.NSEC3 && c.param != nil {
+			c.Config = DenialConfig{NSEC3: true, Salt: c.param.Salt, Iterations: c.param.Iterations}
+		}
+		c.byKey = nsec3
+		for h := range nsec3 {
+			c.owners = append(c.owners, h)
+		}
+		sort.Strings(c.owners)
+		return c
+	}
+	c.Config = DenialConfig{}
+	c.byKey = nsec
+	for name := range nsec {
+		c.owners = append(c.owners, name)
+	}
+	sort.Slice(c.owners, func(i, j int) bool {
+		return CanonicalLess(c.owners[i], c.owners[j])
+	})
+	return c
+}
+
+// authoritative returns the owners of types that are authoritative data of
+// zone or delegation points, the latter holding only their NS and DS, and
+// which delegation points have no DS
+func authoritative(zone string, types map[string][]uint16) (map[string][]uint16, map[string]bool) {
+	cuts := map[string]bool{}
+	for name, t := range types {
+		if name != zone && slices.Contains(t, dns.TypeNS) {
+			cuts[name] = true
+		}
+	}
+
+	below := func(name string) bool {
+		for parent := ParentName(name); parent != "" && parent != zone; parent = ParentName(parent) {
+			if cuts[parent] {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := map[string][]uint16{}
+	insecure := map[string]bool{}
+	for name, t := range types {
+		switch {
+		case below(name):
+			continue
+		case cuts[name]:
+			var kept []uint16
+			for _, rrtype := range t {
+				if rrtype == dns.TypeNS || rrtype == dns.TypeDS {
+					kept = append(kept, rrtype)
+				}
+			}
+			out[name] = kept
+			insecure[name] = !slices.Contains(kept, dns.TypeDS)
+		default:
+			out[name] = t
+		}
+	}
+	return out, insecure
+}
+
+// Param returns the NSEC3PARAM record for the apex, or nil for NSEC zones
+func (c *Chain) Param() *dns.NSEC3PARAM {
+	return c.param
+}
+
+// Match returns the NSEC/NSEC3 record owned by (or hashed from) name
+func (c *Chain) Match(name string) dns.RR {
+	return c.byKey[c.key(name)]
+}
+
+// Cover returns the NSEC/NSEC3 record whose interval covers name, or nil if
+// name exists in the chain
+func (c *Chain) Cover(name string) dns.RR {
+	if len(c.owners) == 0 {
+		return nil
+	}
+	key := c.key(name)
+	if _, ok := c.byKey[key]; ok {
+		return nil
+	}
+	less := func(i int) bool { return !c.before(c.owners[i], key) }
+	i := sort.Search(len(c.owners), less) - 1
+	if i < 0 {
+		// Before the first owner: covered by the last record wrapping around
+		i = len(c.owners) - 1
+	}
+	return c.byKey[c.owners[i]]
+}
+
+// Records returns every record of the chain in order
+func (c *Chain) Records() []dns.RR {
+	out := make([]dns.RR, 0, len(c.owners))
+	for _, key := range c.owners {
+		out = append(out, c.byKey[key])
+	}
+	return out
+}
+
+// Signed returns rr followed by its RRSIGs, signing it on first use and
+// again once the signatures are no longer fresh
+func (c *Chain) Signed(rr dns.RR) []dns.RR {
+	key := rr.Header().Name + "/" + dns.TypeToString[rr.Header().Rrtype]
+	if sigs, ok := c.sigs.Load(key); ok && Fresh(sigs.([]dns.RR)) {
+		return append([]dns.RR{rr}, sigs.([]dns.RR)...)
+	}
+	sigs, err := SignRRSetAll([]dns.RR{rr}, c.Zone)
+	if err != nil || len(sigs) == 0 {
+		return []dns.RR{rr}
+	}
+	c.sigs.Store(key, sigs)
+	return append([]dns.RR{rr}, sigs...)
+}
+
+func (c *Chain) key(name string) string {
+	name = dns.Fqdn(strings.ToLower(name))
+	if c.Config.NSEC3 {
+		return dns.HashName(name, dns.SHA1, c.Config.Iterations, c.Config.Salt)
+	}
+	return name
+}
+
+func (c *Chain) before(a, b string) bool {
+	if c.Config.NSEC3 {
+		return a < b
+	}
+	return CanonicalLess(a, b)
+}
+
+// CanonicalLess orders names as in RFC 4034 section 6.1: label by label
+// from the right, comparing lowercased label bytes
+func CanonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// ParentName strips the first label of name, returning "" for the root
+func ParentName(name string) string {
+	next, end := dns.NextLabel(name, 0)
+	if end {
+		return ""
+	}
+	return name[next:]
+}
+
+func sortedTypes(types []uint16) []uint16 {
+	seen := map[uint16]bool{}
+	var out []uint16
+	for _, t := range types {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
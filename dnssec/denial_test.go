@@ -0,0 +1,229 @@
+package dnssec
+
+import (
+	"math/rand"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalLess(t *testing.T) {
+	// RFC 4034 section 6.1, less the names with escaped octets
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			if got, want := CanonicalLess(ordered[i], ordered[j]), i < j; got != want {
+				t.Errorf("CanonicalLess(%q, %q) = %v, want %v", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	shuffled := slices.Clone(ordered)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	sort.Slice(shuffled, func(i, j int) bool { return CanonicalLess(shuffled[i], shuffled[j]) })
+	if !slices.Equal(shuffled, ordered) {
+		t.Errorf("sorted to %v", shuffled)
+	}
+}
+
+// testZone has an empty non-terminal (b), a secure delegation, an insecure
+// one with glue below it and a wildcard
+const testZone = "example."
+
+var testTypes = map[string][]uint16{
+	"example.":             {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY},
+	"www.example.":         {dns.TypeA, dns.TypeAAAA},
+	"a.b.example.":         {dns.TypeTXT},
+	"*.example.":           {dns.TypeMX},
+	"secure.example.":      {dns.TypeNS, dns.TypeDS},
+	"sub.example.":         {dns.TypeNS, dns.TypeA},
+	"ns.sub.example.":      {dns.TypeA},
+	"deep.ns.sub.example.": {dns.TypeTXT},
+}
+
+func TestBuildChainNSEC(t *testing.T) {
+	c := BuildChain(testZone, testTypes, DenialConfig{}, 300)
+
+	want := []struct {
+		owner, next string
+		types       []uint16
+	}{
+		{"example.", "*.example.", []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{"*.example.", "a.b.example.", []uint16{dns.TypeMX, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"a.b.example.", "secure.example.", []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"secure.example.", "sub.example.", []uint16{dns.TypeNS, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"sub.example.", "www.example.", []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"www.example.", "example.", []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+	records := c.Records()
+	if len(records) != len(want) {
+		t.Fatalf("chain has %d records, want %d: %v", len(records), len(want), records)
+	}
+	for i, rr := range records {
+		nsec := rr.(*dns.NSEC)
+		if nsec.Hdr.Name != want[i].owner || nsec.NextDomain != want[i].next {
+			t.Errorf("record %d is %s -> %s, want %s -> %s", i, nsec.Hdr.Name, nsec.NextDomain, want[i].owner, want[i].next)
+		}
+		if !slices.Equal(nsec.TypeBitMap, want[i].types) {
+			t.Errorf("%s types %v, want %v", nsec.Hdr.Name, nsec.TypeBitMap, want[i].types)
+		}
+		if nsec.Hdr.Ttl != 300 {
+			t.Errorf("%s TTL %d, want 300", nsec.Hdr.Name, nsec.Hdr.Ttl)
+		}
+	}
+	if c.Param() != nil {
+		t.Error("NSEC chain has an NSEC3PARAM")
+	}
+}
+
+func TestBuildChainNSEC3(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    DenialConfig
+		owners []string // names that must be hashed into the chain
+		types  map[string][]uint16
+	}{
+		{
+			name: "without opt-out",
+			cfg:  DenialConfig{NSEC3: true, Salt: "aabbccdd", Iterations: 0},
+			owners: []string{"example.", "*.example.", "a.b.example.", "b.example.", "secure.example.",
+				"sub.example.", "www.example."},
+			types: map[string][]uint16{
+				"b.example.":   nil,
+				"sub.example.": {dns.TypeNS},
+				"www.example.": {dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG},
+			},
+		},
+		{
+			name:   "opt-out",
+			cfg:    DenialConfig{NSEC3: true, Iterations: 5, OptOut: true},
+			owners: []string{"example.", "*.example.", "a.b.example.", "b.example.", "secure.example.", "www.example."},
+			types: map[string][]uint16{
+				"secure.example.": {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := BuildChain(testZone, testTypes, tt.cfg, 300)
+			hash := func(name string) string {
+				return dns.HashName(name, dns.SHA1, tt.cfg.Iterations, tt.cfg.Salt)
+			}
+
+			var want []string
+			for _, name := range tt.owners {
+				want = append(want, hash(name))
+			}
+			sort.Strings(want)
+
+			records := c.Records()
+			if len(records) != len(want) {
+				t.Fatalf("chain has %d records, want %d", len(records), len(want))
+			}
+			for i, rr := range records {
+				nsec3 := rr.(*dns.NSEC3)
+				if got := strings.ToUpper(dns.SplitDomainName(nsec3.Hdr.Name)[0]); got != want[i] {
+					t.Errorf("record %d owner hash %s, want %s", i, got, want[i])
+				}
+				if !dns.IsSubDomain(testZone, nsec3.Hdr.Name) {
+					t.Errorf("record %d owner %s outside the zone", i, nsec3.Hdr.Name)
+				}
+				if next := want[(i+1)%len(want)]; nsec3.NextDomain != next {
+					t.Errorf("record %d next %s, want %s", i, nsec3.NextDomain, next)
+				}
+				if wantFlags := uint8(map[bool]int{true: 1}[tt.cfg.OptOut]); nsec3.Flags != wantFlags {
+					t.Errorf("record %d flags %d, want %d", i, nsec3.Flags, wantFlags)
+				}
+				if nsec3.Salt != tt.cfg.Salt || nsec3.Iterations != tt.cfg.Iterations {
+					t.Errorf("record %d salt %q/%d iterations, want %q/%d", i, nsec3.Salt, nsec3.Iterations, tt.cfg.Salt, tt.cfg.Iterations)
+				}
+			}
+			for name, types := range tt.types {
+				nsec3, ok := c.Match(name).(*dns.NSEC3)
+				if !ok {
+					t.Fatalf("no NSEC3 for %s", name)
+				}
+				if !slices.Equal(nsec3.TypeBitMap, types) {
+					t.Errorf("%s types %v, want %v", name, nsec3.TypeBitMap, types)
+				}
+			}
+
+			param := c.Param()
+			if param == nil || param.Salt != tt.cfg.Salt || param.Iterations != tt.cfg.Iterations || param.Hdr.Name != testZone {
+				t.Errorf("NSEC3PARAM %v does not match %+v", param, tt.cfg)
+			}
+		})
+	}
+}
+
+func TestLoadChain(t *testing.T) {
+	configs := []DenialConfig{
+		{},
+		{NSEC3: true, Salt: "aabbccdd", Iterations: 3},
+		{NSEC3: true, OptOut: true},
+	}
+	for _, cfg := range configs {
+		built := BuildChain(testZone, testTypes, cfg, 300)
+		records := built.Records()
+		if param := built.Param(); param != nil {
+			records = append(records, param)
+		}
+		// Stored records come back in no particular order
+		rand.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+
+		loaded := LoadChain(testZone, records)
+		if !reflect.DeepEqual(loaded.Config, cfg) {
+			t.Errorf("%+v: loaded config %+v", cfg, loaded.Config)
+		}
+		if !reflect.DeepEqual(loaded.Records(), built.Records()) {
+			t.Errorf("%+v: loaded chain differs from the built one", cfg)
+		}
+
+		for _, name := range []string{"c.example.", "zzz.example.", "a.a.b.example.", "example."} {
+			if got, want := loaded.Cover(name), built.Cover(name); got != want {
+				t.Errorf("%+v: Cover(%s) = %v, want %v", cfg, name, got, want)
+			}
+		}
+	}
+
+	if c := LoadChain(testZone, nil); len(c.Records()) != 0 || c.Cover("www.example.") != nil {
+		t.Error("chain loaded from no records is not empty")
+	}
+}
+
+func TestChainCover(t *testing.T) {
+	c := BuildChain(testZone, testTypes, DenialConfig{}, 300)
+	tests := []struct {
+		name  string
+		owner string // "" when name exists
+	}{
+		{"example.", ""},
+		{"www.example.", ""},
+		{"a.example.", "*.example."},
+		{"c.example.", "a.b.example."},
+		{"b.example.", "*.example."},
+		{"x.a.b.example.", "a.b.example."},
+		{"zzz.example.", "www.example."},
+	}
+	for _, tt := range tests {
+		rr := c.Cover(tt.name)
+		switch {
+		case tt.owner == "" && rr != nil:
+			t.Errorf("Cover(%s) = %v, want nil", tt.name, rr)
+		case tt.owner != "" && (rr == nil || rr.Header().Name != tt.owner):
+			t.Errorf("Cover(%s) = %v, want the NSEC at %s", tt.name, rr, tt.owner)
+		}
+	}
+}
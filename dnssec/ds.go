@@ -0,0 +1,81 @@
+package dnssec
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// DSRecords returns the DS records (SHA-256 and SHA-384) the parent should
+// hold for zone: one pair per active KSK, or per active key when the zone
+// has no KSK, plus one for a KSK waiting for its DS to take over
+func DSRecords(zone string) []*dns.DS {
+	var out []*dns.DS
+	for _, kp := range append(SigningKeys(zone, dns.TypeDNSKEY), waitingKSKs(zone)...) {
+		for _, digest := range []uint8{dns.SHA256, dns.SHA384} {
+			if ds := kp.Public.ToDS(digest); ds != nil {
+				out = append(out, ds)
+			}
+		}
+	}
+	return out
+}
+
+// waitingKSKs returns the published KSKs of zone. A KSK is only published
+// ahead of activation when it is to take over from a combined key, and it
+// waits there until the parent holds its DS.
+func waitingKSKs(zone string) []*KeyPair {
+	var out []*KeyPair
+	for _, kp := range GetKeys(zone) {
+		if kp.IsKSK() && kp.State.State == StatePublished {
+			out = append(out, kp)
+		}
+	}
+	return out
+}
+
+// CDS modes per zone (RFC 7344 / RFC 8078)
+const (
+	CDSPublish = "publish" // signal the current KSK to the parent
+	CDSNone    = "none"    // publish nothing
+	CDSDelete  = "delete"  // ask the parent to remove the DS and go insecure
+)
+
+// CDSRecords returns the apex CDS and CDNSKEY RRsets for zone in the given
+// mode. While a KSK rollover is running only the newest KSK is signalled, so
+// the parent swaps straight to it. A KSK waiting to take over from a
+// combined key is signalled alongside it, since the combined key still
+// signs the DNSKEY RRset and its DS must stay.
+func CDSRecords(zone, mode string) (cds, cdnskey []dns.RR) {
+	zone = dns.Fqdn(zone)
+	switch mode {
+	case CDSDelete:
+		hdr := func(t uint16) dns.RR_Header {
+			return dns.RR_Header{Name: zone, Rrtype: t, Class: dns.ClassINET, Ttl: 3600}
+		}
+		// Delete sentinels from RFC 8078 section 4
+		cds = []dns.RR{&dns.CDS{DS: dns.DS{Hdr: hdr(dns.TypeCDS), Digest: "00"}}}
+		cdnskey = []dns.RR{&dns.CDNSKEY{DNSKEY: dns.DNSKEY{Hdr: hdr(dns.TypeCDNSKEY), Protocol: 3, PublicKey: "AA=="}}}
+		return cds, cdnskey
+	case CDSPublish:
+	default:
+		return nil, nil
+	}
+
+	keys := SigningKeys(zone, dns.TypeDNSKEY)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].State.Activate.After(keys[j].State.Activate)
+	})
+	for _, kp := range append([]*KeyPair{keys[0]}, waitingKSKs(zone)...) {
+		for _, digest := range []uint8{dns.SHA256, dns.SHA384} {
+			if ds := kp.Public.ToDS(digest); ds != nil {
+				cds = append(cds, ds.ToCDS())
+			}
+		}
+		cdnskey = append(cdnskey, kp.Public.ToCDNSKEY())
+	}
+	return cds, cdnskey
+}
@@ -1,24 +1,62 @@
 package dnssec
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dnslite/config"
 
 	"github.com/miekg/dns"
+	"github.com/youmark/pkcs8"
 )
 
+// KeyPair holds a zone signing key. Private is an *rsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey matching Public.Algorithm, or a
+// signer backed by a PKCS#11 token.
 type KeyPair struct {
-	Private *rsa.PrivateKey
+	Private crypto.Signer
 	Public  *dns.DNSKEY
+	State   KeyState
+
+	base string // path prefix of the key files; secrets/<zone>/dnskey for the legacy pair
+}
+
+// clone returns a copy of the key whose state can be changed without
+// racing the handlers reading the loaded one
+func (kp *KeyPair) clone() *KeyPair {
+	c := *kp
+	return &c
 }
 
-var zoneKeys = map[string]*KeyPair{}
+// IsKSK reports whether the key has the SEP flag, i.e. signs only the
+// DNSKEY RRset and is what the parent's DS points at
+func (kp *KeyPair) IsKSK() bool {
+	return kp.Public.Flags&dns.SEP != 0
+}
+
+var (
+	zoneKeys = map[string][]*KeyPair{}
+	keysMu   sync.RWMutex
+)
 
+// LoadAllZoneKeys loads every key in secretsDir/<zone>/: the legacy
+// dnskey.txt + key.pem pair and any number of K<zone>+<alg>+<tag>.key files
+// with a matching .pem private key (or .pkcs11 token reference) and optional
+// .state lifecycle file. A key that cannot be loaded is an error: serving
+// the zone without it would leave it unsigned or signed by the wrong keys.
 func LoadAllZoneKeys(secretsDir string) error {
 	entries, err := os.ReadDir(secretsDir)
 	if err != nil {
@@ -30,28 +68,133 @@ func LoadAllZoneKeys(secretsDir string) error {
 			continue
 		}
 		zone := dns.Fqdn(entry.Name())
-		pubPath := filepath.Join(secretsDir, entry.Name(), "dnskey.txt")
-		privPath := filepath.Join(secretsDir, entry.Name(), "key.pem")
+		keys, err := loadZoneKeys(filepath.Join(secretsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			keysMu.Lock()
+			zoneKeys[zone] = keys
+			keysMu.Unlock()
+		}
+	}
+	return nil
+}
+
+func loadZoneKeys(dir string) ([]*KeyPair, error) {
+	pubPaths, _ := filepath.Glob(filepath.Join(dir, "K*.key"))
+	if _, err := os.Stat(filepath.Join(dir, "dnskey.txt")); err == nil {
+		pubPaths = append([]string{filepath.Join(dir, "dnskey.txt")}, pubPaths...)
+	}
+
+	var keys []*KeyPair
+	for _, pubPath := range pubPaths {
+		base := strings.TrimSuffix(pubPath, ".key")
+		privPath := base + ".pem"
+		if filepath.Base(pubPath) == "dnskey.txt" {
+			base, privPath = filepath.Join(dir, "dnskey"), filepath.Join(dir, "key.pem")
+		} else if _, err := os.Stat(privPath); os.IsNotExist(err) {
+			privPath = base + ".pkcs11"
+		}
 
 		keypair, err := loadKeyPair(pubPath, privPath)
 		if err != nil {
+			return nil, fmt.Errorf("DNSSEC key %s: %w", pubPath, err)
+		}
+		keypair.base = base
+		if keypair.State, err = loadState(base, pubPath); err != nil {
+			return nil, fmt.Errorf("DNSSEC key %s: %w", pubPath, err)
+		}
+		if keypair.State.State == StateRemoved {
 			continue
 		}
-		zoneKeys[zone] = keypair
+		keys = append(keys, keypair)
 	}
-	return nil
+	return keys, nil
 }
 
-func loadKeyPair(pubPath, privPath string) (*KeyPair, error) {
-	privData, err := ioutil.ReadFile(privPath)
+// KeyFileBase returns the path prefix genkey uses for a key's files
+func KeyFileBase(secretsDir string, dnskey *dns.DNSKEY) string {
+	zone := dns.Fqdn(strings.ToLower(dnskey.Hdr.Name))
+	return filepath.Join(secretsDir, zone, fmt.Sprintf("K%s+%03d+%05d", zone, dnskey.Algorithm, dnskey.KeyTag()))
+}
+
+// keyBits is the key size passed to DNSKEY.Generate for each algorithm
+var keyBits = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+	dns.ED25519:         256,
+}
+
+// GenerateKey creates a new key for zone, writes its .key, .pem and .state
+// files under secretsDir/<zone>/ and returns it. The key starts in the
+// given lifecycle state. The .pem is encrypted when a key-encryption key is
+// configured.
+func GenerateKey(secretsDir, zone string, alg uint8, ksk bool, ttl uint32, state string) (*KeyPair, error) {
+	if keyBits[alg] == 0 {
+		return nil, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+
+	dnskey := newDNSKEY(zone, alg, ksk, ttl)
+	priv, err := dnskey.Generate(keyBits[alg])
+	if err != nil {
+		return nil, err
+	}
+	privPEM, err := encodePrivateKey(priv)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(privData)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("invalid PEM private key")
+
+	base := KeyFileBase(secretsDir, dnskey)
+	if err := os.MkdirAll(filepath.Dir(base), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".pem", privPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".key", []byte(dnskey.String()+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	kp := &KeyPair{Private: priv.(crypto.Signer), Public: dnskey, base: base}
+	kp.State.Generated = time.Now().UTC()
+	if err := kp.setState(state, kp.State.Generated); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// newDNSKEY returns a DNSKEY without key material: flags 256, plus the SEP
+// bit for a KSK
+func newDNSKEY(zone string, alg uint8, ksk bool, ttl uint32) *dns.DNSKEY {
+	flags := uint16(256)
+	if ksk {
+		flags |= dns.SEP
+	}
+	return &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+}
+
+// loadKeyPair reads a DNSKEY and its private half: a .pem file, or a
+// .pkcs11 reference to a key held in a token
+func loadKeyPair(pubPath, privPath string) (*KeyPair, error) {
+	var priv crypto.Signer
+	var err error
+	if filepath.Ext(privPath) == ".pkcs11" {
+		priv, err = loadTokenSigner(privPath)
+	} else {
+		priv, err = loadPrivateKeyFile(privPath)
 	}
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
@@ -69,14 +212,231 @@ func loadKeyPair(pubPath, privPath string) (*KeyPair, error) {
 		return nil, errors.New("invalid DNSKEY")
 	}
 
+	if err := checkAlgorithm(priv, dnskey.Algorithm); err != nil {
+		return nil, err
+	}
+	if _, ok := priv.(*tokenSigner); ok {
+		// Token keys are found by id alone; make sure it is the right one
+		want, err := dnskeyPublicKey(priv.Public())
+		if err != nil {
+			return nil, err
+		}
+		if want != strings.ReplaceAll(dnskey.PublicKey, " ", "") {
+			return nil, errors.New("token key does not match the DNSKEY")
+		}
+	}
+
 	return &KeyPair{Private: priv, Public: dnskey}, nil
 }
 
-func GetKeyPair(zone string) *KeyPair {
-	return zoneKeys[dns.Fqdn(zone)]
+func loadPrivateKeyFile(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := config.KeyEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	priv, encrypted, err := parsePrivateKey(data, kek)
+	if err != nil {
+		return nil, err
+	}
+	// With a key-encryption key configured every key on disk must use it;
+	// a plaintext one is either left over or planted
+	if kek != nil && !encrypted {
+		return nil, fmt.Errorf("%s is not encrypted although a key-encryption key is set; run tools/encryptkeys.go", path)
+	}
+	return priv, nil
+}
+
+// parsePrivateKey accepts PKCS#8 ("PRIVATE KEY") for every algorithm, the
+// legacy PKCS#1 RSA and SEC 1 EC encodings, and PKCS#8 encrypted with kek
+// ("ENCRYPTED PRIVATE KEY"). It reports whether the key was encrypted.
+func parsePrivateKey(data, kek []byte) (crypto.Signer, bool, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, false, errors.New("invalid PEM private key")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if kek == nil {
+			return nil, true, errors.New("key is encrypted but neither DNSSEC_KEK nor DNSSEC_KEK_FILE is set")
+		}
+		key, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, kek)
+	default:
+		return nil, false, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	encrypted := block.Type == "ENCRYPTED PRIVATE KEY"
+	if err != nil {
+		return nil, encrypted, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, encrypted, errors.New("unsupported PKCS#8 key type")
+	}
+	return signer, encrypted, nil
+}
+
+// encodePrivateKey returns priv as PEM: encrypted PKCS#8 (PBES2 with
+// PBKDF2-SHA256 and AES-256-CBC) when a key-encryption key is configured,
+// plain PKCS#8 otherwise
+func encodePrivateKey(priv crypto.PrivateKey) ([]byte, error) {
+	kek, err := config.KeyEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if kek == nil {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := pkcs8.MarshalPrivateKey(priv, kek, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncryptKeyFile rewrites a plaintext private key file encrypted with the
+// configured key-encryption key. It reports whether the file was changed;
+// files that are already encrypted are left alone.
+func EncryptKeyFile(path string) (bool, error) {
+	kek, err := config.KeyEncryptionKey()
+	if err != nil {
+		return false, err
+	}
+	if kek == nil {
+		return false, errors.New("set DNSSEC_KEK or DNSSEC_KEK_FILE first")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	priv, encrypted, err := parsePrivateKey(data, kek)
+	if err != nil || encrypted {
+		return false, err
+	}
+	out, err := encodePrivateKey(priv)
+	if err != nil {
+		return false, err
+	}
+
+	// Write beside the original and rename, so a crash never leaves a
+	// half-written key behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// checkAlgorithm makes sure the private key can produce signatures for the
+// DNSKEY algorithm it is published under
+func checkAlgorithm(priv crypto.Signer, alg uint8) error {
+	switch k := priv.Public().(type) {
+	case *rsa.PublicKey:
+		if alg == dns.RSASHA256 || alg == dns.RSASHA512 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if (alg == dns.ECDSAP256SHA256 && k.Curve == elliptic.P256()) ||
+			(alg == dns.ECDSAP384SHA384 && k.Curve == elliptic.P384()) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == dns.ED25519 {
+			return nil
+		}
+	}
+	return fmt.Errorf("private key %T does not match DNSKEY algorithm %s", priv.Public(), dns.AlgorithmToString[alg])
+}
+
+// GetKeys returns every key loaded for zone, whatever its state
+func GetKeys(zone string) []*KeyPair {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return append([]*KeyPair(nil), zoneKeys[dns.Fqdn(strings.ToLower(zone))]...)
+}
+
+// IsSigned reports whether zone has at least one active key
+func IsSigned(zone string) bool {
+	for _, kp := range GetKeys(zone) {
+		if kp.State.State == StateActive {
+			return true
+		}
+	}
+	return false
+}
+
+// DNSKEYs returns the apex DNSKEY RRset of zone: every published, active
+// or retired KSK and ZSK
+func DNSKEYs(zone string) []dns.RR {
+	var out []dns.RR
+	for _, kp := range GetKeys(zone) {
+		if kp.State.Published() {
+			out = append(out, kp.Public)
+		}
+	}
+	return out
+}
+
+// SigningKeys returns the active keys that sign RRsets of rrtype in zone:
+// KSKs for the DNSKEY, CDS and CDNSKEY RRsets and ZSKs for everything else.
+// A zone with only one kind of active key uses it for both (a combined
+// signing key).
+func SigningKeys(zone string, rrtype uint16) []*KeyPair {
+	var ksks, zsks []*KeyPair
+	for _, kp := range GetKeys(zone) {
+		if kp.State.State != StateActive {
+			continue
+		}
+		if kp.IsKSK() {
+			ksks = append(ksks, kp)
+		} else {
+			zsks = append(zsks, kp)
+		}
+	}
+	if signedByKSK(rrtype) && len(ksks) > 0 || len(zsks) == 0 {
+		return ksks
+	}
+	return zsks
+}
+
+// signedByKSK reports whether RRsets of rrtype are signed by the KSKs. CDS
+// and CDNSKEY must validate against the current DS (RFC 7344 section 4.1).
+func signedByKSK(rrtype uint16) bool {
+	return rrtype == dns.TypeDNSKEY || rrtype == dns.TypeCDS || rrtype == dns.TypeCDNSKEY
+}
+
+// SigningKey picks the key that signs RRsets of rrtype in zone
+func SigningKey(zone string, rrtype uint16) *KeyPair {
+	keys := SigningKeys(zone, rrtype)
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[0]
 }
 
 func GetAllZones() []string {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
 	keys := make([]string, 0, len(zoneKeys))
 	for zone := range zoneKeys {
 		keys = append(keys, zone)
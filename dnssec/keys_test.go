@@ -0,0 +1,62 @@
+package dnssec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadAllZoneKeys(t *testing.T) {
+	const zone = "example."
+	tests := []struct {
+		name         string
+		writeKEK     string // DNSSEC_KEK when the key is written
+		loadKEK      string // DNSSEC_KEK when it is loaded
+		corruptState bool
+		wantErr      bool
+	}{
+		{name: "plaintext"},
+		{name: "encrypted", writeKEK: "kek", loadKEK: "kek"},
+		{name: "plaintext with a KEK set", loadKEK: "kek", wantErr: true},
+		{name: "encrypted without the KEK", writeKEK: "kek", wantErr: true},
+		{name: "encrypted with another KEK", writeKEK: "kek", loadKEK: "other", wantErr: true},
+		{name: "bad state file", corruptState: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secretsDir := t.TempDir()
+			dir := filepath.Join(secretsDir, zone)
+			t.Setenv("DNSSEC_KEK", tt.writeKEK)
+			writeLegacyKey(t, dir, zone, 257, time.Now())
+			if tt.corruptState {
+				if err := os.WriteFile(filepath.Join(dir, "dnskey.state"), []byte("{"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer func() {
+				keysMu.Lock()
+				delete(zoneKeys, zone)
+				keysMu.Unlock()
+			}()
+
+			t.Setenv("DNSSEC_KEK", tt.loadKEK)
+			err := LoadAllZoneKeys(secretsDir)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadAllZoneKeys succeeded, want an error")
+				}
+				if len(GetKeys(zone)) != 0 {
+					t.Error("keys were loaded for the zone despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadAllZoneKeys: %v", err)
+			}
+			if !IsSigned(zone) {
+				t.Error("zone is not signed after loading its key")
+			}
+		})
+	}
+}
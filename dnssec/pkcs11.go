@@ -0,0 +1,577 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dnslite/config"
+
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+)
+
+// Keys can live in a PKCS#11 token (an HSM, or SoftHSM2 for testing) instead
+// of a .pem file. Such a key has a K<zone>+<alg>+<tag>.pkcs11 file next to
+// its .key naming the token label and the CKA_ID of the key pair:
+//
+//	{"token": "dnslite", "id": "5f2c0e9a1b7d4c33"}
+//
+// The library comes from PKCS11_MODULE and the user PIN from PKCS11_PIN or
+// PKCS11_PIN_FILE.
+
+// TokenRef locates a key pair inside a PKCS#11 token
+type TokenRef struct {
+	Token string `json:"token"`
+	ID    string `json:"id"` // hex CKA_ID
+}
+
+// PKCS#11 3.0 EdDSA constants, which miekg/pkcs11 does not define yet
+const (
+	ckkECEdwards           = 0x40
+	ckmECEdwardsKeyPairGen = 0x1055
+	ckmEdDSA               = 0x1057
+)
+
+// tokenKeyIDLength is the size of the random CKA_ID given to new token keys
+const tokenKeyIDLength = 8
+
+// DER-encoded curve OIDs for CKA_EC_PARAMS
+var (
+	oidP256    = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	oidP384    = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}
+	oidEd25519 = []byte{0x06, 0x03, 0x2b, 0x65, 0x70}
+)
+
+// DigestInfo prefixes for CKM_RSA_PKCS, which signs a ready-made DigestInfo
+var rsaDigestInfo = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var (
+	p11Mu     sync.Mutex
+	p11Ctx    *pkcs11.Ctx
+	p11Tokens = map[string]*tokenSession{}
+)
+
+// tokenSession is a logged-in session on one token. PKCS#11 sessions run one
+// operation at a time, so every call on the session holds mu. When the token
+// drops the session, as it does when it is reset or pulled, the session is
+// reopened and generation counts up so signers look their keys up again.
+type tokenSession struct {
+	mu         sync.Mutex
+	label      string
+	ctx        *pkcs11.Ctx
+	handle     pkcs11.SessionHandle
+	generation int
+}
+
+// openToken returns the session for the token with the given label, loading
+// the module and logging in on first use
+func openToken(label string) (*tokenSession, error) {
+	p11Mu.Lock()
+	defer p11Mu.Unlock()
+
+	if ts, ok := p11Tokens[label]; ok {
+		return ts, nil
+	}
+	if p11Ctx == nil {
+		module := config.PKCS11Module()
+		if module == "" {
+			return nil, errors.New("PKCS11_MODULE is not set")
+		}
+		ctx := pkcs11.New(module)
+		if ctx == nil {
+			return nil, fmt.Errorf("cannot load PKCS#11 module %s", module)
+		}
+		if err := ctx.Initialize(); err != nil {
+			return nil, fmt.Errorf("initializing %s: %w", module, err)
+		}
+		p11Ctx = ctx
+	}
+
+	ts := &tokenSession{label: label, ctx: p11Ctx}
+	if err := ts.open(); err != nil {
+		return nil, err
+	}
+	p11Tokens[label] = ts
+	return ts, nil
+}
+
+// open finds the token by its label, opens a session on it and logs in,
+// closing the session it replaces. The slot is looked up each time, as it
+// can change when the token is reset. Callers hold mu, except on first use.
+func (ts *tokenSession) open() error {
+	if ts.handle != 0 {
+		ts.ctx.CloseSession(ts.handle)
+		ts.handle = 0
+	}
+
+	slots, err := ts.ctx.GetSlotList(true)
+	if errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)) {
+		if err = ts.ctx.Initialize(); err == nil {
+			slots, err = ts.ctx.GetSlotList(true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := ts.ctx.GetTokenInfo(slot)
+		if err != nil || strings.TrimRight(info.Label, " \x00") != ts.label {
+			continue
+		}
+		handle, err := ts.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return err
+		}
+		pin, err := config.PKCS11PIN()
+		if err != nil {
+			ts.ctx.CloseSession(handle)
+			return err
+		}
+		if err := ts.ctx.Login(handle, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			ts.ctx.CloseSession(handle)
+			return fmt.Errorf("login to token %q: %w", ts.label, err)
+		}
+		ts.handle = handle
+		ts.generation++
+		return nil
+	}
+	return fmt.Errorf("no PKCS#11 token labelled %q", ts.label)
+}
+
+// run calls op with the session held. If the token has lost the session, it
+// opens a new one, logs in again and calls op once more.
+func (ts *tokenSession) run(op func() error) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	err := op()
+	if !sessionLost(err) {
+		return err
+	}
+	log.Printf("⚠️ PKCS#11 session on token %q lost (%v), logging in again", ts.label, err)
+	if err := ts.open(); err != nil {
+		return fmt.Errorf("reopening token %q: %w", ts.label, err)
+	}
+	return op()
+}
+
+// sessionLost reports whether err means the session, or the handles it
+// gave out, are gone and a new session is needed
+func sessionLost(err error) bool {
+	var rv pkcs11.Error
+	if !errors.As(err, &rv) {
+		return false
+	}
+	switch rv {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN, pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+		pkcs11.CKR_OBJECT_HANDLE_INVALID, pkcs11.CKR_KEY_HANDLE_INVALID:
+		return true
+	}
+	return false
+}
+
+// destroy removes the public and private key objects with CKA_ID id
+func (ts *tokenSession) destroy(id []byte) error {
+	var errs []error
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		obj, err := ts.find(class, id)
+		if err == nil {
+			err = ts.run(func() error {
+				return ts.ctx.DestroyObject(ts.handle, obj)
+			})
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// find returns the single object of the given class with CKA_ID id
+func (ts *tokenSession) find(class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	var obj pkcs11.ObjectHandle
+	err := ts.run(func() error {
+		var err error
+		obj, err = ts.findLocked(class, id)
+		return err
+	})
+	return obj, err
+}
+
+func (ts *tokenSession) findLocked(class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	if err := ts.ctx.FindObjectsInit(ts.handle, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := ts.ctx.FindObjects(ts.handle, 2)
+	ts.ctx.FindObjectsFinal(ts.handle)
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("found %d objects with id %x, want 1", len(objects), id)
+	}
+	return objects[0], nil
+}
+
+func (ts *tokenSession) attributes(obj pkcs11.ObjectHandle, types ...uint) (map[uint][]byte, error) {
+	template := make([]*pkcs11.Attribute, len(types))
+	for i, t := range types {
+		template[i] = pkcs11.NewAttribute(t, nil)
+	}
+	var attrs []*pkcs11.Attribute
+	err := ts.run(func() error {
+		var err error
+		attrs, err = ts.ctx.GetAttributeValue(ts.handle, obj, template)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := map[uint][]byte{}
+	for _, a := range attrs {
+		out[a.Type] = a.Value
+	}
+	return out, nil
+}
+
+// publicKey reads the public half of a token key pair
+func (ts *tokenSession) publicKey(obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := ts.attributes(obj, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	switch bytesToUint(attrs[pkcs11.CKA_KEY_TYPE]) {
+	case pkcs11.CKK_RSA:
+		attrs, err := ts.attributes(obj, pkcs11.CKA_MODULUS, pkcs11.CKA_PUBLIC_EXPONENT)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[pkcs11.CKA_MODULUS]),
+			E: int(new(big.Int).SetBytes(attrs[pkcs11.CKA_PUBLIC_EXPONENT]).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attrs, err := ts.attributes(obj, pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
+		if err != nil {
+			return nil, err
+		}
+		var curve elliptic.Curve
+		switch params := attrs[pkcs11.CKA_EC_PARAMS]; {
+		case bytes.Equal(params, oidP256):
+			curve = elliptic.P256()
+		case bytes.Equal(params, oidP384):
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %x", params)
+		}
+		x, y := elliptic.Unmarshal(curve, unwrapOctets(attrs[pkcs11.CKA_EC_POINT]))
+		if x == nil {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case ckkECEdwards:
+		attrs, err := ts.attributes(obj, pkcs11.CKA_EC_POINT)
+		if err != nil {
+			return nil, err
+		}
+		point := unwrapOctets(attrs[pkcs11.CKA_EC_POINT])
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 point")
+		}
+		return ed25519.PublicKey(point), nil
+	}
+	return nil, errors.New("unsupported key type in token")
+}
+
+// tokenSigner is a crypto.Signer whose private key never leaves the token.
+// Signatures come back in the encodings crypto/rsa, crypto/ecdsa and
+// crypto/ed25519 produce, so dns.RRSIG.Sign treats it like an in-memory key.
+// The key handle belongs to a session generation and is found again by id
+// after the session is reopened.
+type tokenSigner struct {
+	session    *tokenSession
+	id         []byte
+	key        pkcs11.ObjectHandle
+	generation int
+	public     crypto.PublicKey
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mech uint
+	data := digest
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := rsaDigestInfo[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v for RSA", opts.HashFunc())
+		}
+		mech, data = pkcs11.CKM_RSA_PKCS, append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mech = pkcs11.CKM_ECDSA
+	case ed25519.PublicKey:
+		mech = ckmEdDSA
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	ts := s.session
+	var sig []byte
+	err := ts.run(func() error {
+		if s.generation != ts.generation {
+			key, err := ts.findLocked(pkcs11.CKO_PRIVATE_KEY, s.id)
+			if err != nil {
+				return err
+			}
+			s.key, s.generation = key, ts.generation
+		}
+		err := ts.ctx.SignInit(ts.handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, s.key)
+		if err == nil {
+			sig, err = ts.ctx.Sign(ts.handle, data)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mech == pkcs11.CKM_ECDSA {
+		// The token returns r || s; crypto.Signer callers expect ASN.1
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// loadTokenSigner opens the key a .pkcs11 reference file points at
+func loadTokenSigner(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ref TokenRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, fmt.Errorf("invalid token reference: %w", err)
+	}
+	id, err := hex.DecodeString(ref.ID)
+	if err != nil || len(id) == 0 {
+		return nil, fmt.Errorf("invalid key id %q", ref.ID)
+	}
+
+	ts, err := openToken(ref.Token)
+	if err != nil {
+		return nil, err
+	}
+	pubObj, err := ts.find(pkcs11.CKO_PUBLIC_KEY, id)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ts.publicKey(pubObj)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ts.find(pkcs11.CKO_PRIVATE_KEY, id); err != nil {
+		return nil, err
+	}
+	// The private key handle is looked up on first use
+	return &tokenSigner{session: ts, id: id, public: pub}, nil
+}
+
+// GenerateTokenKey is GenerateKey for a key pair created inside the PKCS#11
+// token with the given label. Only the DNSKEY, a .pkcs11 reference and the
+// .state file are written to secretsDir.
+func GenerateTokenKey(secretsDir, zone, token string, alg uint8, ksk bool, ttl uint32, state string) (_ *KeyPair, err error) {
+	ts, err := openToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, tokenKeyIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	var mech uint
+	switch alg {
+	case dns.RSASHA256:
+		mech = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, keyBits[alg]),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	case dns.ECDSAP256SHA256:
+		mech = pkcs11.CKM_EC_KEY_PAIR_GEN
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256))
+	case dns.ECDSAP384SHA384:
+		mech = pkcs11.CKM_EC_KEY_PAIR_GEN
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP384))
+	case dns.ED25519:
+		mech = ckmECEdwardsKeyPairGen
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidEd25519))
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+
+	var pubObj, privObj pkcs11.ObjectHandle
+	var generation int
+	err = ts.run(func() error {
+		var err error
+		pubObj, privObj, err = ts.ctx.GenerateKeyPair(ts.handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, public, private)
+		generation = ts.generation
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating key in token %q: %w", token, err)
+	}
+	// A half-made key would be loaded, or fail to load, at the next start
+	var base string
+	defer func() {
+		if err == nil {
+			return
+		}
+		if derr := ts.destroy(id); derr != nil {
+			log.Printf("⚠️ Could not remove key %s from token %q: %v", hex.EncodeToString(id), token, derr)
+		}
+		if base != "" {
+			for _, ext := range []string{".pkcs11", ".key", ".state"} {
+				os.Remove(base + ext)
+			}
+		}
+	}()
+
+	pub, err := ts.publicKey(pubObj)
+	if err != nil {
+		return nil, err
+	}
+
+	dnskey := newDNSKEY(zone, alg, ksk, ttl)
+	if dnskey.PublicKey, err = dnskeyPublicKey(pub); err != nil {
+		return nil, err
+	}
+	base = KeyFileBase(secretsDir, dnskey)
+
+	// Label both halves after the key files so they are easy to find
+	label := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, filepath.Base(base))}
+	ts.mu.Lock()
+	err = ts.ctx.SetAttributeValue(ts.handle, pubObj, label)
+	if err == nil {
+		err = ts.ctx.SetAttributeValue(ts.handle, privObj, label)
+	}
+	ts.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("labelling key in token %q: %w", token, err)
+	}
+
+	ref, err := json.MarshalIndent(TokenRef{Token: token, ID: hex.EncodeToString(id)}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".pkcs11", append(ref, '\n'), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".key", []byte(dnskey.String()+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	signer := &tokenSigner{session: ts, id: id, key: privObj, generation: generation, public: pub}
+	kp := &KeyPair{Private: signer, Public: dnskey, base: base}
+	kp.State.Generated = time.Now().UTC()
+	if err := kp.setState(state, kp.State.Generated); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// dnskeyPublicKey encodes pub as DNSKEY public key data: RFC 3110 for RSA,
+// RFC 6605 for ECDSA and RFC 8080 for Ed25519
+func dnskeyPublicKey(pub crypto.PublicKey) (string, error) {
+	var raw []byte
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		exp := big.NewInt(int64(k.E)).Bytes()
+		if len(exp) < 256 {
+			raw = append(raw, byte(len(exp)))
+		} else {
+			raw = append(raw, 0, byte(len(exp)>>8), byte(len(exp)))
+		}
+		raw = append(append(raw, exp...), k.N.Bytes()...)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		raw = append(k.X.FillBytes(make([]byte, size)), k.Y.FillBytes(make([]byte, size))...)
+	case ed25519.PublicKey:
+		raw = k
+	default:
+		return "", errors.New("unsupported public key type")
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// unwrapOctets strips the DER OCTET STRING that tokens put around
+// CKA_EC_POINT, passing raw points through
+func unwrapOctets(b []byte) []byte {
+	var inner []byte
+	if rest, err := asn1.Unmarshal(b, &inner); err == nil && len(rest) == 0 {
+		return inner
+	}
+	return b
+}
+
+// bytesToUint decodes a CK_ULONG attribute value, which is in host order
+func bytesToUint(b []byte) uint {
+	switch len(b) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package dnssec
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dnslite/config"
+
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+)
+
+// TestTokenKeys generates a key of each algorithm in a PKCS#11 token, loads
+// it back from its files as the server does and checks that its signatures
+// verify. It needs PKCS11_MODULE, PKCS11_PIN and a token labelled
+// PKCS11_TOKEN (default "dnslite"), e.g. from SoftHSM2:
+//
+//	softhsm2-util --init-token --free --label dnslite --pin 1234 --so-pin 5678
+//	PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_PIN=1234 go test ./dnssec
+func TestTokenKeys(t *testing.T) {
+	if config.PKCS11Module() == "" {
+		t.Skip("PKCS11_MODULE is not set")
+	}
+	token := os.Getenv("PKCS11_TOKEN")
+	if token == "" {
+		token = "dnslite"
+	}
+	const zone = "pkcs11-test.example."
+
+	for _, alg := range []uint8{dns.RSASHA256, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519} {
+		t.Run(dns.AlgorithmToString[alg], func(t *testing.T) {
+			secrets := t.TempDir()
+			kp, err := GenerateTokenKey(secrets, zone, token, alg, false, 3600, StateActive)
+			if errors.Is(err, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)) {
+				t.Skipf("token cannot make %s keys", dns.AlgorithmToString[alg])
+			}
+			if err != nil {
+				t.Fatalf("GenerateTokenKey: %v", err)
+			}
+			t.Cleanup(func() { destroyTokenKey(t, kp) })
+
+			keys, err := loadZoneKeys(filepath.Join(secrets, zone))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 {
+				t.Fatalf("loaded %d keys, want 1", len(keys))
+			}
+			loaded := keys[0]
+			if loaded.Public.KeyTag() != kp.Public.KeyTag() {
+				t.Fatalf("loaded key %d, want %d", loaded.Public.KeyTag(), kp.Public.KeyTag())
+			}
+
+			rrset := []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1"),
+			}}
+			now := time.Now()
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				Algorithm:  alg,
+				KeyTag:     loaded.Public.KeyTag(),
+				SignerName: zone,
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				Expiration: uint32(now.Add(time.Hour).Unix()),
+			}
+			if err := sig.Sign(loaded.Private, rrset); err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if err := sig.Verify(loaded.Public, rrset); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+// destroyTokenKey removes both halves of a test key from the token
+func destroyTokenKey(t *testing.T, kp *KeyPair) {
+	signer := kp.Private.(*tokenSigner)
+	if err := signer.session.destroy(signer.id); err != nil {
+		t.Logf("could not remove key %s from the token: %v", hex.EncodeToString(signer.id), err)
+	}
+}
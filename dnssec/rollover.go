@@ -0,0 +1,502 @@
+package dnssec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Key lifecycle states. Published, active and retired keys appear in the
+// DNSKEY RRset; only active keys sign.
+const (
+	StateGenerated = "generated"
+	StatePublished = "published"
+	StateActive    = "active"
+	StateRetired   = "retired"
+	StateRemoved   = "removed"
+)
+
+// KeyState is the lifecycle of a key, persisted as K<zone>+<alg>+<tag>.state
+// (dnskey.state for the legacy pair)
+type KeyState struct {
+	State     string    `json:"state"`
+	Generated time.Time `json:"generated,omitzero"`
+	Publish   time.Time `json:"publish,omitzero"`
+	Activate  time.Time `json:"activate,omitzero"`
+	Retire    time.Time `json:"retire,omitzero"`
+	Remove    time.Time `json:"remove,omitzero"`
+}
+
+// Published reports whether a key in this state belongs in the DNSKEY RRset
+func (s KeyState) Published() bool {
+	return s.State == StatePublished || s.State == StateActive || s.State == StateRetired
+}
+
+// loadState reads the .state file of a key. Keys from before lifecycle
+// tracking have none until their state first changes, and are treated as
+// active since their file was written.
+func loadState(base, pubPath string) (KeyState, error) {
+	legacy := KeyState{State: StateActive}
+	if info, err := os.Stat(pubPath); err == nil {
+		legacy.Publish = info.ModTime().UTC()
+		legacy.Activate = legacy.Publish
+	}
+
+	data, err := os.ReadFile(base + ".state")
+	if os.IsNotExist(err) {
+		return legacy, nil
+	}
+	if err != nil {
+		return KeyState{}, err
+	}
+	var state KeyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return KeyState{}, fmt.Errorf("invalid state file: %w", err)
+	}
+	return state, nil
+}
+
+// setState moves the key to state at the given time and persists it
+func (kp *KeyPair) setState(state string, at time.Time) error {
+	kp.State.State = state
+	switch state {
+	case StatePublished:
+		kp.State.Publish = at
+	case StateActive:
+		if kp.State.Publish.IsZero() {
+			kp.State.Publish = at
+		}
+		kp.State.Activate = at
+	case StateRetired:
+		kp.State.Retire = at
+	case StateRemoved:
+		kp.State.Remove = at
+	}
+	data, err := json.MarshalIndent(kp.State, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(kp.base+".state", append(data, '\n'), 0600)
+}
+
+// Policy drives automatic rollovers for a zone. It is read from
+// secrets/<zone>/policy.json; zones without one are never rolled.
+type Policy struct {
+	// Algorithm, when set, is the algorithm the zone is rolled to. Without
+	// it new keys use the zone's current algorithm.
+	Algorithm        string   `json:"algorithm"`
+	ZSKLifetime      Duration `json:"zsk_lifetime"`
+	KSKLifetime      Duration `json:"ksk_lifetime"`
+	PropagationDelay Duration `json:"propagation_delay"`
+	MaxZoneTTL       Duration `json:"max_zone_ttl"`
+	DSWait           Duration `json:"ds_wait"`
+	DNSKEYTTL        uint32   `json:"dnskey_ttl"`
+
+	// Token, when set, is the label of the PKCS#11 token new keys are
+	// generated in
+	Token string `json:"pkcs11_token"`
+}
+
+// generate creates a key for zone as the policy says: in its token if it
+// has one, on disk otherwise
+func (p *Policy) generate(secretsDir, zone string, alg uint8, ksk bool, state string) (*KeyPair, error) {
+	if p.Token != "" {
+		return GenerateTokenKey(secretsDir, zone, p.Token, alg, ksk, p.DNSKEYTTL, state)
+	}
+	return GenerateKey(secretsDir, zone, alg, ksk, p.DNSKEYTTL, state)
+}
+
+// Duration is a time.Duration that reads from JSON strings such as "1h30m"
+// or "90d"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func loadPolicy(dir string) (*Policy, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{
+		PropagationDelay: Duration(time.Hour),
+		MaxZoneTTL:       Duration(24 * time.Hour),
+		DSWait:           Duration(48 * time.Hour),
+		DNSKEYTTL:        3600,
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if _, ok := dns.StringToAlgorithm[strings.ToUpper(p.Algorithm)]; p.Algorithm != "" && !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", p.Algorithm)
+	}
+	return p, nil
+}
+
+// algorithm returns the algorithm new keys of a zone are made with. Without
+// one in the policy that is the algorithm of the zone's oldest active key,
+// since switching algorithm needs a rollover of its own (RFC 4035 section
+// 2.2), and ECDSAP256SHA256 for a zone with no keys yet.
+func (p *Policy) algorithm(keys []*KeyPair) uint8 {
+	if p.Algorithm != "" {
+		return dns.StringToAlgorithm[strings.ToUpper(p.Algorithm)]
+	}
+	var oldest *KeyPair
+	for _, kp := range keys {
+		if kp.State.State == StateActive && (oldest == nil || kp.State.Activate.Before(oldest.State.Activate)) {
+			oldest = kp
+		}
+	}
+	if oldest == nil {
+		return dns.ECDSAP256SHA256
+	}
+	return oldest.Public.Algorithm
+}
+
+// StartRolloverScheduler checks every zone with a policy each interval and
+// advances its keys through pre-publish ZSK and double-signature KSK
+// rollovers. onChange is called for a zone whenever its signing keys change
+// so stored signatures can be dropped.
+func StartRolloverScheduler(secretsDir string, interval time.Duration, onChange func(zone string)) {
+	go func() {
+		for {
+			RunRollovers(secretsDir, onChange)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RunRollovers performs one pass of the rollover scheduler
+func RunRollovers(secretsDir string, onChange func(zone string)) {
+	entries, err := os.ReadDir(secretsDir)
+	if err != nil {
+		log.Printf("❌ Rollover: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(secretsDir, entry.Name())
+		policy, err := loadPolicy(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		zone := dns.Fqdn(entry.Name())
+		if err != nil {
+			log.Printf("⚠️ Rollover: bad policy for %s: %v", zone, err)
+			continue
+		}
+
+		changed, err := rollZone(secretsDir, zone, policy, time.Now().UTC())
+		if err != nil {
+			log.Printf("❌ Rollover for %s failed: %v", zone, err)
+		}
+		if changed {
+			keys, err := loadZoneKeys(dir)
+			if err != nil {
+				// Keep serving with the keys loaded before
+				log.Printf("❌ Reloading keys for %s after the rollover failed: %v", zone, err)
+				continue
+			}
+			keysMu.Lock()
+			zoneKeys[zone] = keys
+			keysMu.Unlock()
+			if onChange != nil {
+				onChange(zone)
+			}
+		}
+	}
+}
+
+// rollZone advances the key states of one zone and reports whether anything
+// changed. It works on copies of the loaded keys, which DNS handlers read
+// without a lock; RunRollovers loads the saved states in their place.
+func rollZone(secretsDir, zone string, p *Policy, now time.Time) (bool, error) {
+	keys := GetKeys(zone)
+	alg := p.algorithm(keys)
+	propagation := time.Duration(p.PropagationDelay)
+	dnskeyTTL := time.Duration(p.DNSKEYTTL) * time.Second
+	changed := false
+
+	var zsks, ksks, oldAlg []*KeyPair
+	for _, kp := range keys {
+		kp = kp.clone()
+		switch {
+		case kp.Public.Algorithm != alg:
+			oldAlg = append(oldAlg, kp)
+		case kp.IsKSK():
+			ksks = append(ksks, kp)
+		default:
+			zsks = append(zsks, kp)
+		}
+	}
+
+	// ZSK: pre-publish. The successor sits in the DNSKEY RRset until every
+	// cache has seen it, then takes over signing; the old key stays published
+	// until signatures made with it have expired from caches.
+	var active, incoming *KeyPair
+	for _, kp := range zsks {
+		switch kp.State.State {
+		case StateActive:
+			active = kp
+		case StatePublished:
+			incoming = kp
+		case StateRetired:
+			if now.After(kp.State.Retire.Add(time.Duration(p.MaxZoneTTL) + propagation)) {
+				log.Printf("🔑 %s: removing retired ZSK %d", zone, kp.Public.KeyTag())
+				if err := kp.setState(StateRemoved, now); err != nil {
+					return changed, err
+				}
+				changed = true
+			}
+		}
+	}
+	switch {
+	case active == nil && incoming == nil && hasActive(ksks):
+		// A sole KSK signs everything as a combined key; its successor as
+		// ZSK is pre-published like any other
+		kp, err := p.generate(secretsDir, zone, alg, false, StatePublished)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: pre-publishing ZSK %d to take over from the combined key", zone, kp.Public.KeyTag())
+		changed = true
+	case active == nil && incoming == nil:
+		kp, err := p.generate(secretsDir, zone, alg, false, StateActive)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: created initial ZSK %d", zone, kp.Public.KeyTag())
+		changed = true
+	case incoming != nil && now.After(incoming.State.Publish.Add(dnskeyTTL+propagation)):
+		if active != nil {
+			if err := active.setState(StateRetired, now); err != nil {
+				return changed, err
+			}
+		}
+		if err := incoming.setState(StateActive, now); err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: ZSK %d is now active", zone, incoming.Public.KeyTag())
+		changed = true
+	// A combined key is not rolled as a ZSK; it hands the DNSKEY RRset to a
+	// KSK first
+	case incoming == nil && active != nil && hasActive(ksks) && p.ZSKLifetime > 0 &&
+		now.After(active.State.Activate.Add(time.Duration(p.ZSKLifetime))):
+		kp, err := p.generate(secretsDir, zone, alg, false, StatePublished)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: pre-publishing ZSK %d to replace %d", zone, kp.Public.KeyTag(), active.Public.KeyTag())
+		changed = true
+	}
+
+	// KSK: double signature. The successor signs the DNSKEY RRset alongside
+	// the old KSK while the parent swaps the DS; the old one then retires.
+	var activeKSKs, waiting []*KeyPair
+	for _, kp := range ksks {
+		switch kp.State.State {
+		case StateActive:
+			activeKSKs = append(activeKSKs, kp)
+		case StatePublished:
+			waiting = append(waiting, kp)
+		case StateRetired:
+			if now.After(kp.State.Retire.Add(dnskeyTTL + propagation)) {
+				log.Printf("🔑 %s: removing retired KSK %d", zone, kp.Public.KeyTag())
+				if err := kp.setState(StateRemoved, now); err != nil {
+					return changed, err
+				}
+				changed = true
+			}
+		}
+	}
+	sort.Slice(activeKSKs, func(i, j int) bool {
+		return activeKSKs[i].State.Activate.Before(activeKSKs[j].State.Activate)
+	})
+	switch {
+	case len(activeKSKs) == 0 && len(waiting) > 0:
+		// The combined key keeps signing the DNSKEY RRset until the parent
+		// holds a DS for its successor; switching earlier leaves the RRset
+		// signed only by a key no DS points at
+		kp := waiting[0]
+		if !now.After(kp.State.Publish.Add(dnskeyTTL + propagation)) {
+			break
+		}
+		seen, err := parentHasDS(zone, kp.Public)
+		if err != nil {
+			log.Printf("⚠️ %s: looking up the DS of KSK %d: %v", zone, kp.Public.KeyTag(), err)
+			break
+		}
+		if !seen {
+			break
+		}
+		if err := kp.setState(StateActive, now); err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: DS for KSK %d is at the parent, KSK is now active", zone, kp.Public.KeyTag())
+		changed = true
+	case len(activeKSKs) == 0 && active != nil:
+		kp, err := p.generate(secretsDir, zone, alg, true, StatePublished)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: publishing KSK %d to take over from the combined key — add its DS at the parent", zone, kp.Public.KeyTag())
+		changed = true
+	case len(activeKSKs) == 0:
+		kp, err := p.generate(secretsDir, zone, alg, true, StateActive)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: created initial KSK %d — publish its DS at the parent", zone, kp.Public.KeyTag())
+		changed = true
+	case len(activeKSKs) == 1 && p.KSKLifetime > 0 &&
+		now.After(activeKSKs[0].State.Activate.Add(time.Duration(p.KSKLifetime))):
+		kp, err := p.generate(secretsDir, zone, alg, true, StateActive)
+		if err != nil {
+			return changed, err
+		}
+		log.Printf("🔑 %s: KSK rollover started, new KSK %d — replace the DS at the parent", zone, kp.Public.KeyTag())
+		changed = true
+	case len(activeKSKs) > 1:
+		newest := activeKSKs[len(activeKSKs)-1]
+		if now.After(newest.State.Activate.Add(dnskeyTTL + propagation + time.Duration(p.DSWait))) {
+			for _, old := range activeKSKs[:len(activeKSKs)-1] {
+				log.Printf("🔑 %s: retiring KSK %d", zone, old.Public.KeyTag())
+				if err := old.setState(StateRetired, now); err != nil {
+					return changed, err
+				}
+			}
+			changed = true
+		}
+	}
+
+	// Algorithm rollover: a new algorithm gets its first ZSK and KSK above,
+	// active at once, so every RRset is signed with both algorithms while
+	// both are in the DNSKEY RRset. Once the DS has been replaced and the
+	// old signatures have left caches, the old algorithm's keys are removed
+	// together; retiring them would leave its DNSKEYs published without
+	// signatures (RFC 6781 section 4.1.4).
+	if len(oldAlg) > 0 && len(activeKSKs) > 0 && active != nil {
+		since := activeKSKs[0].State.Activate
+		if active.State.Activate.After(since) {
+			since = active.State.Activate
+		}
+		if now.After(since.Add(dnskeyTTL + propagation + time.Duration(p.DSWait) + time.Duration(p.MaxZoneTTL))) {
+			for _, kp := range oldAlg {
+				log.Printf("🔑 %s: removing %s key %d after the algorithm rollover", zone, dns.AlgorithmToString[kp.Public.Algorithm], kp.Public.KeyTag())
+				if err := kp.setState(StateRemoved, now); err != nil {
+					return changed, err
+				}
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// hasActive reports whether any of keys is active
+func hasActive(keys []*KeyPair) bool {
+	for _, kp := range keys {
+		if kp.State.State == StateActive {
+			return true
+		}
+	}
+	return false
+}
+
+// parentHasDS reports whether the parent of zone publishes a DS matching
+// key, asking the resolvers in /etc/resolv.conf. It is a variable so tests
+// can stand in for the parent.
+var parentHasDS = func(zone string, key *dns.DNSKEY) (bool, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return false, err
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeDS)
+	c := &dns.Client{Timeout: 5 * time.Second}
+	err = errors.New("no resolvers in /etc/resolv.conf")
+	for _, server := range conf.Servers {
+		var r *dns.Msg
+		if r, _, err = c.Exchange(m, net.JoinHostPort(server, conf.Port)); err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("DS query answered %s", dns.RcodeToString[r.Rcode])
+			continue
+		}
+		for _, rr := range r.Answer {
+			if ds, ok := rr.(*dns.DS); ok && matchesDS(key, ds) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, err
+}
+
+// matchesDS reports whether ds points at key
+func matchesDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	want := key.ToDS(ds.DigestType)
+	return want != nil && want.KeyTag == ds.KeyTag && want.Algorithm == ds.Algorithm &&
+		strings.EqualFold(want.Digest, ds.Digest)
+}
+
+// KeyInfo describes a key for the /status endpoint
+type KeyInfo struct {
+	KeyTag    uint16 `json:"key_tag"`
+	Algorithm string `json:"algorithm"`
+	Role      string `json:"role"`
+	KeyState
+}
+
+// KeyStatus lists the keys and lifecycle state of every zone
+func KeyStatus() map[string][]KeyInfo {
+	out := map[string][]KeyInfo{}
+	for _, zone := range GetAllZones() {
+		for _, kp := range GetKeys(zone) {
+			role := "ZSK"
+			if kp.IsKSK() {
+				role = "KSK"
+			}
+			out[zone] = append(out[zone], KeyInfo{
+				KeyTag:    kp.Public.KeyTag(),
+				Algorithm: dns.AlgorithmToString[kp.Public.Algorithm],
+				Role:      role,
+				KeyState:  kp.State,
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package dnssec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRollLegacyKey(t *testing.T) {
+	const zone = "example."
+	type step struct {
+		after    time.Duration // since the previous pass
+		atParent bool          // whether the parent has the new KSK's DS
+		keys     int
+		// whether the legacy key still signs the DNSKEY RRset and the rest
+		dnskeyByLegacy, dataByLegacy bool
+		ds                           int // keys the parent should hold a DS for
+	}
+	tests := []struct {
+		name  string
+		flags uint16
+		steps []step
+	}{
+		{
+			name:  "ZSK flags",
+			flags: 256,
+			steps: []step{
+				{0, false, 2, true, true, 2},
+				{3 * time.Hour, false, 2, true, true, 2},
+				{0, true, 2, false, true, 1},
+				// Only now is the old key rolled as the ZSK it has become
+				{0, true, 3, false, true, 1},
+			},
+		},
+		{
+			name:  "KSK flags",
+			flags: 257,
+			steps: []step{
+				{0, false, 2, true, true, 1},
+				{3 * time.Hour, false, 2, true, false, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secretsDir := t.TempDir()
+			dir := filepath.Join(secretsDir, zone)
+			legacy := writeLegacyKey(t, dir, zone, tt.flags, time.Now().AddDate(-1, 0, 0))
+
+			atParent := false
+			defer func(orig func(string, *dns.DNSKEY) (bool, error)) { parentHasDS = orig }(parentHasDS)
+			parentHasDS = func(string, *dns.DNSKEY) (bool, error) { return atParent, nil }
+
+			policy := &Policy{
+				ZSKLifetime:      Duration(90 * 24 * time.Hour),
+				PropagationDelay: Duration(time.Hour),
+				MaxZoneTTL:       Duration(24 * time.Hour),
+				DSWait:           Duration(48 * time.Hour),
+				DNSKEYTTL:        3600,
+			}
+			now := time.Now().UTC()
+			load := func() {
+				keys, err := loadZoneKeys(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				keysMu.Lock()
+				zoneKeys[zone] = keys
+				keysMu.Unlock()
+			}
+			load()
+			defer func() {
+				keysMu.Lock()
+				delete(zoneKeys, zone)
+				keysMu.Unlock()
+			}()
+
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				atParent = s.atParent
+				if _, err := rollZone(secretsDir, zone, policy, now); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				load()
+
+				if n := len(GetKeys(zone)); n != s.keys {
+					t.Errorf("step %d: %d keys, want %d", i, n, s.keys)
+				}
+				for _, rrtype := range []uint16{dns.TypeDNSKEY, dns.TypeA} {
+					want := map[uint16]bool{dns.TypeDNSKEY: s.dnskeyByLegacy, dns.TypeA: s.dataByLegacy}[rrtype]
+					keys := SigningKeys(zone, rrtype)
+					if len(keys) != 1 {
+						t.Fatalf("step %d: %d keys sign %s, want 1", i, len(keys), dns.TypeToString[rrtype])
+					}
+					if got := keys[0].Public.KeyTag() == legacy.KeyTag(); got != want {
+						t.Errorf("step %d: %s signed by the legacy key = %v, want %v", i, dns.TypeToString[rrtype], got, want)
+					}
+				}
+				if n := len(DSRecords(zone)); n != 2*s.ds {
+					t.Errorf("step %d: %d DS records, want %d", i, n, 2*s.ds)
+				}
+				if _, cdnskey := CDSRecords(zone, CDSPublish); len(cdnskey) != s.ds {
+					t.Errorf("step %d: %d CDNSKEY records, want %d", i, len(cdnskey), s.ds)
+				}
+			}
+		})
+	}
+}
+
+// writeLegacyKey writes the dnskey.txt and key.pem pair keys were kept in
+// before lifecycle tracking, dated at
+func writeLegacyKey(t *testing.T, dir, zone string, flags uint16, at time.Time) *dns.DNSKEY {
+	t.Helper()
+	dnskey := newDNSKEY(zone, dns.ECDSAP256SHA256, false, 3600)
+	dnskey.Flags = flags
+	priv, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := encodePrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	pubPath := filepath.Join(dir, "dnskey.txt")
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, []byte(dnskey.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(pubPath, at, at); err != nil {
+		t.Fatal(err)
+	}
+	return dnskey
+}
@@ -1,16 +1,81 @@
 package dnssec
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
+	"sort"
+	"strings"
 	"time"
 
+	"dnslite/config"
+
 	"github.com/miekg/dns"
 )
 
 func SignRRSet(rrset []dns.RR, zone string) (*dns.RRSIG, error) {
-	keypair := GetKeyPair(zone)
+	keypair := SigningKey(zone, rrset[0].Header().Rrtype)
 	if keypair == nil {
 		return nil, nil
 	}
+	return signWith(keypair, rrset, zone)
+}
+
+// SignRRSetAll signs rrset with every active key for its type, so that
+// during a double-signature rollover both KSKs vouch for the DNSKEY RRset
+func SignRRSetAll(rrset []dns.RR, zone string) ([]dns.RR, error) {
+	var sigs []dns.RR
+	for _, keypair := range SigningKeys(zone, rrset[0].Header().Rrtype) {
+		sig, err := signWith(keypair, rrset, zone)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// Unsigned reports whether an active key for the type of rrset has no
+// signature among have
+func Unsigned(rrset []dns.RR, zone string, have []dns.RR) bool {
+	for _, keypair := range SigningKeys(zone, rrset[0].Header().Rrtype) {
+		if !hasSignature(have, keypair.Public) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromOtherKeys returns the signatures among sigs made by a key that has
+// none among have
+func FromOtherKeys(sigs, have []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range sigs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		if !hasSignatureBy(have, sig.KeyTag, sig.Algorithm) {
+			out = append(out, sig)
+		}
+	}
+	return out
+}
+
+func hasSignature(sigs []dns.RR, key *dns.DNSKEY) bool {
+	return hasSignatureBy(sigs, key.KeyTag(), key.Algorithm)
+}
+
+func hasSignatureBy(sigs []dns.RR, keyTag uint16, alg uint8) bool {
+	for _, rr := range sigs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.KeyTag == keyTag && sig.Algorithm == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func signWith(keypair *KeyPair, rrset []dns.RR, zone string) (*dns.RRSIG, error) {
 
 	sig := &dns.RRSIG{
 		Hdr: dns.RR_Header{
@@ -21,9 +86,9 @@ func SignRRSet(rrset []dns.RR, zone string) (*dns.RRSIG, error) {
 		},
 		TypeCovered: rrset[0].Header().Rrtype,
 		Algorithm:   keypair.Public.Algorithm,
-		Labels: uint8(dns.CountLabel(rrset[0].Header().Name)),
+		Labels:      labelCount(rrset[0].Header().Name),
 		OrigTtl:     rrset[0].Header().Ttl,
-		Expiration:  uint32(time.Now().Add(24 * time.Hour).Unix()),
+		Expiration:  uint32(signatureExpiration().Unix()),
 		Inception:   uint32(time.Now().Add(-5 * time.Minute).Unix()),
 		KeyTag:      keypair.Public.KeyTag(),
 		SignerName:  dns.Fqdn(zone),
@@ -33,3 +98,49 @@ func SignRRSet(rrset []dns.RR, zone string) (*dns.RRSIG, error) {
 	}
 	return sig, nil
 }
+
+// labelCount is the RRSIG Labels value for owner: the wildcard label of a
+// wildcard owner is not counted (RFC 4034 section 3.1.3)
+func labelCount(owner string) uint8 {
+	n := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		n--
+	}
+	return uint8(n)
+}
+
+// Fresh reports whether every signature in sigs stays valid beyond the
+// refresh window, so none needs making again yet
+func Fresh(sigs []dns.RR) bool {
+	refresh := time.Now().Add(config.SignatureRefresh)
+	for _, rr := range sigs {
+		if !rr.(*dns.RRSIG).ValidityPeriod(refresh) {
+			return false
+		}
+	}
+	return true
+}
+
+// signatureExpiration is now plus the configured validity, minus a random
+// jitter so a zone's signatures spread their expirations out
+func signatureExpiration() time.Time {
+	validity := config.SignatureValidity
+	if config.SignatureJitter > 0 {
+		validity -= rand.N(config.SignatureJitter)
+	}
+	return time.Now().Add(validity)
+}
+
+// RRSetHash identifies the content of rrset as signed by zone: owner, type,
+// TTL and rdata in canonical order, so equal RRsets share signatures
+func RRSetHash(rrset []dns.RR, zone string) string {
+	lines := make([]string, 0, len(rrset))
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		lines = append(lines, rr.String())
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.ToLower(dns.Fqdn(zone)) + "\n" + strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,50 @@
+package dnssec
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLabelCount(t *testing.T) {
+	tests := []struct {
+		owner string
+		want  uint8
+	}{
+		{".", 0},
+		{"example.", 1},
+		{"www.example.", 2},
+		{"*.example.", 1},
+		{"*.sub.example.", 2},
+		{"a.*.example.", 3},
+		{"**.example.", 2},
+	}
+	for _, tt := range tests {
+		if got := labelCount(tt.owner); got != tt.want {
+			t.Errorf("labelCount(%q) = %d, want %d", tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestFromOtherKeys(t *testing.T) {
+	sig := func(keyTag uint16, alg uint8) dns.RR {
+		return &dns.RRSIG{KeyTag: keyTag, Algorithm: alg}
+	}
+	tests := []struct {
+		name       string
+		sigs, have []dns.RR
+		want       int
+	}{
+		{"nothing stored", []dns.RR{sig(1, 13), sig(2, 13)}, nil, 2},
+		{"one key stored", []dns.RR{sig(1, 13), sig(2, 13)}, []dns.RR{sig(1, 13)}, 1},
+		{"all keys stored", []dns.RR{sig(1, 13)}, []dns.RR{sig(1, 13), sig(2, 13)}, 0},
+		{"same tag, other algorithm", []dns.RR{sig(1, 15)}, []dns.RR{sig(1, 13)}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromOtherKeys(tt.sigs, tt.have); len(got) != tt.want {
+				t.Errorf("FromOtherKeys returned %d signatures, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"log"
+	"strings"
+
+	"dnslite/db"
+
+	"github.com/miekg/dns"
+)
+
+// addAdditional puts the A/AAAA records of MX, NS, SRV, SVCB and HTTPS
+// targets that live in our zones into the additional section, stopping once
+// the next RRset would push the response past budget bytes
+func addAdditional(msg *dns.Msg, do bool, budget int) {
+	seen := map[string]bool{}
+	for _, rr := range msg.Extra {
+		seen[additionalKey(rr)] = true
+	}
+	for _, rr := range msg.Answer {
+		seen[additionalKey(rr)] = true
+	}
+
+	var targets []string
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Ns...) {
+		if target := additionalTarget(rr); target != "" && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	for _, target := range targets {
+		zone, err := db.FindZone(target)
+		if err != nil {
+			log.Printf("DB error: %v", err)
+			return
+		}
+		if zone == "" {
+			continue
+		}
+		// Addresses below a zone cut are glue, never authoritative data
+		if cut, err := db.FindZoneCut(target, zone); err != nil || cut != "" {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if seen[target+"/"+dns.TypeToString[qtype]] {
+				continue
+			}
+			records, err := lookupRRSet(target, qtype, zone)
+			if err != nil {
+				log.Printf("DB error: %v", err)
+				return
+			}
+			if !do {
+				records = withoutSignatures(records)
+			}
+			if len(records) == 0 {
+				continue
+			}
+
+			before := len(msg.Extra)
+			msg.Extra = append(msg.Extra, records...)
+			if msg.Len() > budget {
+				msg.Extra = msg.Extra[:before]
+				return
+			}
+		}
+	}
+}
+
+// additionalTarget returns the host name rr points at, if additional
+// section processing applies to its type
+func additionalTarget(rr dns.RR) string {
+	var target string
+	switch r := rr.(type) {
+	case *dns.MX:
+		target = r.Mx
+	case *dns.NS:
+		target = r.Ns
+	case *dns.SRV:
+		target = r.Target
+	case *dns.SVCB:
+		target = r.Target
+		if target == "." {
+			// RFC 9460: "." in ServiceMode means the owner name itself
+			target = r.Hdr.Name
+		}
+	case *dns.HTTPS:
+		target = r.Target
+		if target == "." {
+			target = r.Hdr.Name
+		}
+	default:
+		return ""
+	}
+	if target == "." {
+		return ""
+	}
+	return strings.ToLower(dns.Fqdn(target))
+}
+
+func additionalKey(rr dns.RR) string {
+	return strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+}
+
+func withoutSignatures(records []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"log"
+	"strings"
+
+	"dnslite/cache"
+	"dnslite/db"
+	"dnslite/dnssec"
+	"dnslite/signer"
+
+	"github.com/miekg/dns"
+)
+
+// Kinds of authenticated denial a response can need (RFC 4035 section 3.1.3,
+// RFC 5155 section 7.2)
+const (
+	proofNoData = iota
+	proofNXDomain
+	proofWildcardAnswer
+	proofWildcardNoData
+	proofInsecureReferral
+)
+
+// getChain returns the NSEC/NSEC3 chain of a zone. Zones we sign get the
+// chain built from their records; otherwise it is the one stored with the
+// zone, which is empty for unsigned zones.
+func getChain(zone string) (*dnssec.Chain, error) {
+	if dnssec.IsSigned(zone) {
+		return signer.ZoneChain(zone)
+	}
+	if chain := cache.GetChain(zone); chain != nil {
+		return chain, nil
+	}
+	records, err := db.QueryZoneRecords(zone, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM)
+	if err != nil {
+		return nil, err
+	}
+	chain := dnssec.LoadChain(zone, records)
+	cache.SetChain(zone, chain)
+	return chain, nil
+}
+
+// addDenial appends the signed NSEC/NSEC3 records proving the given kind of
+// answer to the authority section. encloser is the closest encloser of name
+// for the NXDOMAIN and wildcard kinds.
+func addDenial(msg *dns.Msg, zone string, kind int, name, encloser string) {
+	chain, err := getChain(zone)
+	if err != nil {
+		log.Printf("⚠️ Could not build denial chain for %s: %v", zone, err)
+		return
+	}
+
+	var proof []dns.RR
+	if chain.Config.NSEC3 {
+		proof = nsec3Proof(chain, kind, name, encloser)
+	} else {
+		proof = nsecProof(chain, kind, name, encloser)
+	}
+
+	seen := map[string]bool{}
+	for _, rr := range proof {
+		if rr == nil || seen[rr.Header().Name] {
+			continue
+		}
+		seen[rr.Header().Name] = true
+		msg.Ns = append(msg.Ns, signedDenial(chain, rr, zone)...)
+	}
+}
+
+// signedDenial returns a chain record with its RRSIGs: made from the chain of
+// a zone we sign, otherwise the ones stored with the record
+func signedDenial(chain *dnssec.Chain, rr dns.RR, zone string) []dns.RR {
+	if dnssec.IsSigned(zone) {
+		return chain.Signed(rr)
+	}
+	rrset, err := lookupRRSet(rr.Header().Name, rr.Header().Rrtype, zone)
+	if err != nil || len(rrset) == 0 {
+		return []dns.RR{rr}
+	}
+	return rrset
+}
+
+func nsecProof(chain *dnssec.Chain, kind int, name, encloser string) []dns.RR {
+	switch kind {
+	case proofNoData, proofInsecureReferral:
+		if match := chain.Match(name); match != nil {
+			return []dns.RR{match}
+		}
+		// Empty non-terminal: the covering NSEC shows nothing is owned here
+		return []dns.RR{chain.Cover(name)}
+	case proofNXDomain:
+		return []dns.RR{chain.Cover(name), chain.Cover("*." + encloser)}
+	case proofWildcardAnswer:
+		return []dns.RR{chain.Cover(name)}
+	case proofWildcardNoData:
+		return []dns.RR{chain.Cover(name), chain.Match("*." + encloser)}
+	}
+	return nil
+}
+
+func nsec3Proof(chain *dnssec.Chain, kind int, name, encloser string) []dns.RR {
+	switch kind {
+	case proofNoData, proofInsecureReferral:
+		if match := chain.Match(name); match != nil {
+			return []dns.RR{match}
+		}
+		// Opt-out: prove the closest provable encloser and that the next
+		// closer name is covered by an opt-out span
+		for ce := dnssec.ParentName(name); ce != ""; ce = dnssec.ParentName(ce) {
+			if match := chain.Match(ce); match != nil {
+				return []dns.RR{match, chain.Cover(nextCloser(name, ce))}
+			}
+		}
+		return nil
+	case proofNXDomain:
+		return []dns.RR{
+			chain.Match(encloser),
+			chain.Cover(nextCloser(name, encloser)),
+			chain.Cover("*." + encloser),
+		}
+	case proofWildcardAnswer:
+		return []dns.RR{chain.Cover(nextCloser(name, encloser))}
+	case proofWildcardNoData:
+		return []dns.RR{
+			chain.Match(encloser),
+			chain.Cover(nextCloser(name, encloser)),
+			chain.Match("*." + encloser),
+		}
+	}
+	return nil
+}
+
+// nextCloser is the ancestor of name that is one label longer than encloser
+func nextCloser(name, encloser string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(encloser) + 1
+	if n > len(labels) {
+		return name
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func belowCut(name, zone string, cuts map[string]bool) bool {
+	for parent := dnssec.ParentName(name); parent != "" && parent != zone; parent = dnssec.ParentName(parent) {
+		if cuts[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, have := range types {
+		if have == t {
+			return true
+		}
+	}
+	return false
+}
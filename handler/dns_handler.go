@@ -3,86 +3,356 @@ package handler
 import (
 	"log"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"dnslite/cache"
+	"dnslite/config"
 	"dnslite/db"
 	"dnslite/dnssec"
+	"dnslite/signer"
+	"dnslite/tsig"
 )
 
 func StartDNSServers(addr string) {
 	dns.HandleFunc(".", handleDNS)
 
+	// Every TSIG is checked against the keyring, even when it is empty, so
+	// signed requests with unknown keys get BADKEY
 	go func() {
 		log.Println("Starting UDP DNS on", addr)
-		log.Fatal((&dns.Server{Addr: addr, Net: "udp"}).ListenAndServe())
+		log.Fatal((&dns.Server{Addr: addr, Net: "udp", TsigProvider: tsig.Provider}).ListenAndServe())
 	}()
 
 	log.Println("Starting TCP DNS on", addr)
-	log.Fatal((&dns.Server{Addr: addr, Net: "tcp"}).ListenAndServe())
+	log.Fatal((&dns.Server{Addr: addr, Net: "tcp", TsigProvider: tsig.Provider}).ListenAndServe())
 }
 
+// maxCNAMEChain bounds how many CNAMEs are followed for a single question
+const maxCNAMEChain = 8
+
 func handleDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if r.IsTsig() != nil && w.TsigStatus() != nil {
+		writeTSIGError(w, r, w.TsigStatus())
+		return
+	}
+
 	msg := dns.Msg{}
 	msg.SetReply(r)
-	msg.Authoritative = true
+
+	opt := r.IsEdns0()
+	if opt != nil && opt.Version() != 0 {
+		// We only speak EDNS version 0 (RFC 6891 section 6.1.3)
+		msg.SetEdns0(config.EDNSUDPSize, false)
+		msg.Rcode = dns.RcodeBadVers
+		signReply(&msg, r)
+		w.WriteMsg(&msg)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeNotify {
+		handleNotify(w, r)
+		return
+	}
+
+	// Zone transfers are streamed over several messages
+	if len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		handleTransfer(w, r)
+		return
+	}
 
 	for _, q := range r.Question {
 		name := strings.ToLower(dns.Fqdn(q.Name))
 		qtype := q.Qtype
 
-		records := cache.Get(name, qtype)
-		if records == nil {
-			dbRecords, err := db.QueryRecords(name, qtype)
-			if err != nil {
-				log.Printf("DB error: %v", err)
-				continue
+		zone, err := db.FindZone(name)
+		if err != nil {
+			log.Printf("DB error: %v", err)
+			msg.Rcode = dns.RcodeServerFailure
+			break
+		}
+		if zone == "" {
+			// Not ours: refuse rather than look like a lame authoritative server
+			msg.Rcode = dns.RcodeRefused
+			msg.Authoritative = false
+			break
+		}
+		msg.Authoritative = true
+
+		// DS at a child apex we also host belongs to the parent side of the cut
+		if qtype == dns.TypeDS && name == zone && name != "." {
+			next, _ := dns.NextLabel(name, 0)
+			parent, err := db.FindZone(name[next:])
+			if err == nil && parent != "" {
+				zone = parent
 			}
-			cache.Set(name, qtype, dbRecords)
-			records = dbRecords
-		}
-
-		if len(records) > 0 {
-			// Find matching zone
-			zone := findZoneFor(name)
-
-			// Try to fetch precomputed RRSIG from DB
-			sig, err := db.QueryRRSIG(name, qtype)
-			if err != nil && zone != "" {
-				sigRR, signErr := dnssec.SignRRSet(records, zone)
-				if signErr == nil {
-					_ = db.StoreRRSIG(name, qtype, sigRR)
-					records = append(records, sigRR)
-				}
-			} else if err == nil {
-				records = append(records, sig)
+		}
+
+		if err := answerQuestion(&msg, name, qtype, zone); err != nil {
+			log.Printf("DB error: %v", err)
+			msg.Rcode = dns.RcodeServerFailure
+		}
+	}
+
+	tcp := w.LocalAddr().Network() == "tcp"
+	do, size := negotiatePayload(r, tcp)
+	if !do && len(r.Question) > 0 {
+		stripDNSSEC(&msg, r.Question[0].Qtype)
+	}
+	if opt != nil {
+		msg.SetEdns0(config.EDNSUDPSize, do)
+	}
+	if msg.Rcode == dns.RcodeSuccess {
+		addAdditional(&msg, do, size)
+	}
+	if !tcp {
+		// Sets TC when the answer does not fit, so the client retries over TCP
+		msg.Truncate(size - tsig.Size(requestKey(r)))
+	}
+
+	signReply(&msg, r)
+	w.WriteMsg(&msg)
+}
+
+// answerQuestion fills msg for name/qtype, following CNAMEs through our own
+// zones until the chain ends, loops, leaves our zones or gets too long
+func answerQuestion(msg *dns.Msg, name string, qtype uint16, zone string) error {
+	visited := map[string]bool{name: true}
+
+	for depth := 0; ; depth++ {
+		cut, err := db.FindZoneCut(name, zone)
+		if err != nil {
+			return err
+		}
+		// DS at the cut is authoritative parent data; everything else is referred
+		if cut != "" && !(qtype == dns.TypeDS && name == cut) {
+			if depth > 0 {
+				// Chased into a delegation: let the resolver restart at the target
+				return nil
 			}
+			return addReferral(msg, cut, zone)
 		}
 
+		records, err := lookupOrCNAME(name, qtype, zone)
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			exists, err := db.NameExists(name)
+			if err != nil {
+				return err
+			}
+			if exists || name == zone {
+				addNegativeAnswer(msg, zone, false)
+				addDenial(msg, zone, proofNoData, name, "")
+				return nil
+			}
+
+			encloser, err := closestEncloser(name, zone)
+			if err != nil {
+				return err
+			}
+			wildcard := "*." + encloser
+			hasWildcard, err := db.NameExists(wildcard)
+			if err != nil {
+				return err
+			}
+			if !hasWildcard {
+				addNegativeAnswer(msg, zone, true)
+				addDenial(msg, zone, proofNXDomain, name, encloser)
+				return nil
+			}
+			if records, err = lookupOrCNAME(wildcard, qtype, zone); err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				addNegativeAnswer(msg, zone, false)
+				addDenial(msg, zone, proofWildcardNoData, name, encloser)
+				return nil
+			}
+			records = synthesize(records, name)
+			// Prove the query name itself does not exist
+			addDenial(msg, zone, proofWildcardAnswer, name, encloser)
+		}
 		msg.Answer = append(msg.Answer, records...)
+
+		target := cnameTarget(records)
+		if target == "" || qtype == dns.TypeCNAME {
+			return nil
+		}
+		if visited[target] || depth+1 >= maxCNAMEChain {
+			log.Printf("⚠️ CNAME chain from %s stopped at %s", msg.Question[0].Name, target)
+			return nil
+		}
+		visited[target] = true
+
+		targetZone, err := db.FindZone(target)
+		if err != nil {
+			return err
+		}
+		if targetZone == "" {
+			// Out-of-zone target: the client's resolver continues from here
+			return nil
+		}
+		name, zone = target, targetZone
 	}
+}
 
-	// Always respond with DNSKEY for matching zone
-	for _, q := range r.Question {
-		if q.Qtype == dns.TypeDNSKEY {
-			zone := findZoneFor(q.Name)
-			if kp := dnssec.GetKeyPair(zone); kp != nil && kp.Public.Header().Name == q.Name {
-				msg.Answer = append(msg.Answer, kp.Public)
+// lookupOrCNAME returns the qtype RRset at name, or its CNAME RRset when the
+// name is an alias
+func lookupOrCNAME(name string, qtype uint16, zone string) ([]dns.RR, error) {
+	records, err := lookupRRSet(name, qtype, zone)
+	if err != nil || len(records) > 0 || qtype == dns.TypeCNAME {
+		return records, err
+	}
+	return lookupRRSet(name, dns.TypeCNAME, zone)
+}
+
+// closestEncloser returns the longest existing ancestor of name within zone
+// (RFC 4592). Empty non-terminals count as existing names, so they block
+// wildcards above them.
+func closestEncloser(name, zone string) (string, error) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if encloser == zone {
+			return zone, nil
+		}
+		exists, err := db.NameExists(encloser)
+		if err != nil || exists {
+			return encloser, err
+		}
+	}
+	return zone, nil
+}
+
+// synthesize rewrites the owner of wildcard records (and their RRSIGs,
+// whose Labels field still points at the wildcard) to name
+func synthesize(records []dns.RR, name string) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		out = append(out, rr)
+	}
+	return out
+}
+
+// lookupRRSet returns the RRset for name/qtype with its RRSIGs appended when
+// the zone is signed
+func lookupRRSet(name string, qtype uint16, zone string) ([]dns.RR, error) {
+	var records []dns.RR
+	if qtype == dns.TypeSOA {
+		// SOA lives in the zones table, so only the apex has one
+		if soa, err := db.QuerySOA(name); err == nil {
+			records = []dns.RR{soa}
+		}
+	} else {
+		records = cache.Get(name, qtype)
+	}
+	if records == nil && qtype != dns.TypeSOA {
+		dbRecords, err := db.QueryRecords(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		cache.Set(name, qtype, dbRecords)
+		records = dbRecords
+	}
+
+	if len(records) > 0 && signer.IsOnline(zone) {
+		// Signed on demand; nothing is read from or written to the database
+		records = records[:len(records):len(records)]
+		records = append(records, signer.Online(records, zone)...)
+	} else if len(records) > 0 {
+		// Never append into the cached slice
+		records = records[:len(records):len(records)]
+
+		// Serve every stored RRSIG still in its validity period. An active
+		// key with none stored yet, such as one just activated, signs from
+		// memory; storing signatures is left to the signer, so answering a
+		// query never writes to the database.
+		stored, err := db.QueryRRSIGs(name, qtype)
+		if err != nil {
+			log.Printf("DB error loading RRSIGs for %s: %v", name, err)
+		}
+		var sigs []dns.RR
+		now := time.Now()
+		for _, sig := range stored {
+			if sig.(*dns.RRSIG).ValidityPeriod(now) {
+				sigs = append(sigs, sig)
 			}
 		}
+		if dnssec.Unsigned(records, zone, sigs) {
+			sigs = append(sigs, dnssec.FromOtherKeys(signer.Online(records, zone), sigs)...)
+		}
+		records = append(records, sigs...)
 	}
+	return records, nil
+}
 
-	w.WriteMsg(&msg)
+func cnameTarget(records []dns.RR) string {
+	for _, rr := range records {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return strings.ToLower(dns.Fqdn(cname.Target))
+		}
+	}
+	return ""
 }
 
-// Matches the most specific zone that ends with qname
-func findZoneFor(name string) string {
-	name = dns.Fqdn(name)
-	var match string
-	for _, zone := range dnssec.GetAllZones() {
-		if strings.HasSuffix(name, zone) && len(zone) > len(match) {
-			match = zone
+// addReferral turns msg into a non-authoritative referral to the child zone
+// at cut: its NS set in authority (with the signed DS, if any) and in-zone
+// glue addresses in additional
+func addReferral(msg *dns.Msg, cut, zone string) error {
+	nsSet, err := db.QueryRecords(cut, dns.TypeNS)
+	if err != nil {
+		return err
+	}
+	msg.Authoritative = false
+	msg.Ns = append(msg.Ns, nsSet...)
+
+	ds, err := lookupRRSet(cut, dns.TypeDS, zone)
+	if err != nil {
+		return err
+	}
+	msg.Ns = append(msg.Ns, ds...)
+	if len(ds) == 0 {
+		// Signed parent, unsigned child: prove there is no DS
+		addDenial(msg, zone, proofInsecureReferral, cut, "")
+	}
+
+	for _, rr := range nsSet {
+		target := strings.ToLower(dns.Fqdn(rr.(*dns.NS).Ns))
+		if !dns.IsSubDomain(zone, target) {
+			continue
 		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			glue, err := db.QueryRecords(target, qtype)
+			if err != nil {
+				return err
+			}
+			msg.Extra = append(msg.Extra, glue...)
+		}
+	}
+	return nil
+}
+
+// addNegativeAnswer marks msg as NXDOMAIN or NODATA and places the zone SOA
+// in the authority section with the negative-caching TTL (RFC 2308)
+func addNegativeAnswer(msg *dns.Msg, zone string, nxdomain bool) {
+	if nxdomain {
+		msg.Rcode = dns.RcodeNameError
+	}
+
+	soa, err := lookupRRSet(zone, dns.TypeSOA, zone)
+	if err != nil || len(soa) == 0 {
+		log.Printf("⚠️ No SOA for zone %s: %v", zone, err)
+		return
+	}
+	ttl := min(soa[0].Header().Ttl, soa[0].(*dns.SOA).Minttl)
+	for _, rr := range soa {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		msg.Ns = append(msg.Ns, rr)
 	}
-	return match
 }
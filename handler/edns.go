@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"dnslite/config"
+
+	"github.com/miekg/dns"
+)
+
+// negotiatePayload returns the DO bit and the response size limit for r:
+// 512 bytes without EDNS0, otherwise the client's UDP size capped at our
+// configured maximum. TCP responses are only limited by the protocol.
+func negotiatePayload(r *dns.Msg, tcp bool) (do bool, size int) {
+	size = dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+		size = int(min(opt.UDPSize(), config.EDNSUDPSize))
+		size = max(size, dns.MinMsgSize)
+	}
+	if tcp {
+		size = dns.MaxMsgSize
+	}
+	return do, size
+}
+
+// stripDNSSEC drops DNSSEC records the client did not ask for with the DO
+// bit, keeping any RRset of the explicitly queried type
+func stripDNSSEC(msg *dns.Msg, qtype uint16) {
+	keep := func(records []dns.RR, explicit bool) []dns.RR {
+		out := records[:0]
+		for _, rr := range records {
+			if !isDNSSECType(rr.Header().Rrtype) || (explicit && rr.Header().Rrtype == qtype) {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+	msg.Answer = keep(msg.Answer, true)
+	msg.Ns = keep(msg.Ns, false)
+	msg.Extra = keep(msg.Extra, false)
+}
+
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDS:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"testing"
+
+	"dnslite/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegotiatePayload(t *testing.T) {
+	query := func(udpSize uint16, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.", dns.TypeA)
+		if udpSize > 0 {
+			m.SetEdns0(udpSize, do)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		msg      *dns.Msg
+		tcp      bool
+		wantDO   bool
+		wantSize int
+	}{
+		{"no EDNS", query(0, false), false, false, dns.MinMsgSize},
+		{"small buffer", query(1000, false), false, false, 1000},
+		{"capped at our maximum", query(4096, true), false, true, int(config.EDNSUDPSize)},
+		{"below the minimum", query(100, false), false, false, dns.MinMsgSize},
+		{"TCP without EDNS", query(0, false), true, false, dns.MaxMsgSize},
+		{"TCP with EDNS", query(1232, true), true, true, dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			do, size := negotiatePayload(tt.msg, tt.tcp)
+			if do != tt.wantDO || size != tt.wantSize {
+				t.Errorf("negotiatePayload = %v, %d; want %v, %d", do, size, tt.wantDO, tt.wantSize)
+			}
+		})
+	}
+}
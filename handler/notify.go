@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"log"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// OnNotify is called for each DNS NOTIFY (RFC 1996) with the TSIG key that
+// signed it ("" if none) and reports whether the sender is a primary of the
+// zone, in which case the zone should be checked for changes without
+// blocking. When nil every NOTIFY is refused.
+var OnNotify func(zone string, from netip.Addr, key string) bool
+
+func handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	msg := dns.Msg{}
+	msg.SetReply(r)
+
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		msg.Rcode = dns.RcodeFormatError
+		signReply(&msg, r)
+		w.WriteMsg(&msg)
+		return
+	}
+
+	zone := dns.CanonicalName(r.Question[0].Name)
+	from := remoteAddr(w)
+	key := requestKey(r)
+	if OnNotify == nil || !OnNotify(zone, from, key) {
+		log.Printf("⛔ NOTIFY for %s from %s (key %q) refused", zone, from, key)
+		msg.Rcode = dns.RcodeRefused
+	} else {
+		log.Printf("🔔 NOTIFY for %s from %s", zone, from)
+		msg.Authoritative = true
+	}
+	signReply(&msg, r)
+	w.WriteMsg(&msg)
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"dnslite/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// requestKey returns the name of the TSIG key that signed r, or "" if it is
+// unsigned. Requests whose signature does not verify never get this far.
+func requestKey(r *dns.Msg) string {
+	if t := r.IsTsig(); t != nil {
+		return dns.CanonicalName(t.Hdr.Name)
+	}
+	return ""
+}
+
+// signReply has msg signed with the key of the request it answers, if any.
+// It must be the last thing added to msg.
+func signReply(msg, r *dns.Msg) {
+	if t := r.IsTsig(); t != nil {
+		msg.SetTsig(t.Hdr.Name, t.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
+
+// writeTSIGError answers a request whose TSIG did not verify with NOTAUTH
+// and the TSIG error (RFC 8945 section 5.2). BADKEY and BADSIG go out
+// unsigned; BADTIME is signed and tells the client our clock.
+func writeTSIGError(w dns.ResponseWriter, r *dns.Msg, err error) {
+	t := r.IsTsig()
+	log.Printf("⛔ TSIG from %s with key %s failed: %v", remoteAddr(w), t.Hdr.Name, err)
+
+	msg := dns.Msg{}
+	msg.SetRcode(r, dns.RcodeNotAuth)
+	msg.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+
+	resp := msg.Extra[len(msg.Extra)-1].(*dns.TSIG)
+	resp.Error = tsig.Rcode(err)
+	if resp.Error == dns.RcodeBadTime {
+		resp.TimeSigned = t.TimeSigned
+		resp.OtherLen = 6
+		resp.OtherData = fmt.Sprintf("%012x", time.Now().Unix())
+	}
+	w.WriteMsg(&msg)
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+
+	"dnslite/db"
+	"dnslite/signer"
+
+	"github.com/miekg/dns"
+)
+
+// axfrChunkSize bounds the wire size of the records put in one AXFR message,
+// leaving room for the header, question and a TSIG under the 64KB limit
+const axfrChunkSize = 16 * 1024
+
+var errNoSOA = errors.New("zone has no SOA")
+
+// handleTransfer answers AXFR (RFC 5936) and IXFR (RFC 1995) queries. AXFR
+// streams the whole zone over TCP: the SOA, every RRset of the zone with its
+// signatures, then the SOA again. IXFR sends the changes since the client's
+// serial, signatures included, when the journal has them and the whole zone
+// otherwise.
+func handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	client := remoteAddr(w)
+	tcp := w.LocalAddr().Network() == "tcp"
+
+	refuse := func(rcode int) {
+		msg := dns.Msg{}
+		msg.SetRcode(r, rcode)
+		signReply(&msg, r)
+		w.WriteMsg(&msg)
+	}
+
+	if q.Qtype == dns.TypeAXFR && !tcp {
+		refuse(dns.RcodeRefused)
+		return
+	}
+	found, err := db.FindZone(zone)
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		refuse(dns.RcodeServerFailure)
+		return
+	}
+	if found != zone {
+		refuse(dns.RcodeNotAuth)
+		return
+	}
+	acl, keys, err := db.GetTransferACL(zone)
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		refuse(dns.RcodeServerFailure)
+		return
+	}
+	if !transferAllowed(acl, keys, client, requestKey(r)) {
+		log.Printf("⛔ %s of %s refused for %s (key %q)", dns.TypeToString[q.Qtype], zone, client, requestKey(r))
+		refuse(dns.RcodeRefused)
+		return
+	}
+
+	var records []dns.RR
+	kind := "AXFR"
+	if q.Qtype == dns.TypeIXFR {
+		var clientSOA *dns.SOA
+		if len(r.Ns) > 0 {
+			clientSOA, _ = r.Ns[0].(*dns.SOA)
+		}
+		if clientSOA == nil {
+			// The query carries the client's SOA in authority (RFC 1995 section 3)
+			refuse(dns.RcodeFormatError)
+			return
+		}
+		records, kind, err = ixfrContents(zone, clientSOA.Serial, tcp)
+	} else {
+		records, err = ZoneContents(zone)
+	}
+	if err != nil {
+		log.Printf("❌ %s of %s failed: %v", dns.TypeToString[q.Qtype], zone, err)
+		refuse(dns.RcodeServerFailure)
+		return
+	}
+
+	chunks := chunkRecords(records)
+	ch := make(chan *dns.Envelope, len(chunks))
+	for _, chunk := range chunks {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		log.Printf("❌ %s of %s to %s failed: %v", kind, zone, client, err)
+		return
+	}
+	log.Printf("📤 %s of %s to %s: %d records in %d messages", kind, zone, client, len(records), len(chunks))
+}
+
+// ixfrContents returns the IXFR answer for a client at serial: the current
+// SOA alone when the client is up to date or asked over UDP, the journaled
+// differences when they lead from serial to the current one, and the whole
+// zone otherwise.
+func ixfrContents(zone string, serial uint32, tcp bool) ([]dns.RR, string, error) {
+	soa, err := db.QuerySOA(zone)
+	if err != nil {
+		return nil, "", err
+	}
+	if !db.SerialNewer(soa.Serial, serial) || !tcp {
+		// Over UDP the single SOA tells the client to retry over TCP
+		// (RFC 1995 section 2)
+		return []dns.RR{soa}, "IXFR", nil
+	}
+
+	diffs, err := ZoneDiffs(zone, serial, soa.Serial)
+	if err != nil {
+		return nil, "", err
+	}
+	if diffs != nil {
+		records := []dns.RR{soa}
+		for _, diff := range diffs {
+			records = append(records, withSerial(soa, diff.From))
+			records = append(records, diff.Deleted...)
+			records = append(records, withSerial(soa, diff.To))
+			records = append(records, diff.Added...)
+		}
+		return append(records, soa), "IXFR", nil
+	}
+
+	records, err := ZoneContents(zone)
+	return records, "AXFR-style IXFR", err
+}
+
+// ZoneDiffs returns the journaled differences that take a copy of zone from
+// serial to the current serial, or nil when the journal does not reach back
+// that far and the whole zone has to be sent. The signatures of the current
+// SOA, which are made for each serial and not journaled, are added to the
+// last difference. Zones signed online keep no signatures to journal, so
+// they are always sent whole.
+func ZoneDiffs(zone string, serial, current uint32) ([]db.ZoneDiff, error) {
+	if signer.IsOnline(zone) {
+		return nil, nil
+	}
+	diffs, err := db.GetZoneDiffs(zone, serial)
+	if err != nil || !leadsTo(diffs, serial, current) {
+		return nil, err
+	}
+
+	soa, err := lookupRRSet(zone, dns.TypeSOA, zone)
+	if err != nil {
+		return nil, err
+	}
+	last := &diffs[len(diffs)-1]
+	for _, rr := range soa {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			last.Added = append(last.Added, rr)
+		}
+	}
+	return diffs, nil
+}
+
+// leadsTo reports whether diffs form an unbroken chain of versions from
+// serial from to serial to
+func leadsTo(diffs []db.ZoneDiff, from, to uint32) bool {
+	if len(diffs) == 0 {
+		return false
+	}
+	for _, diff := range diffs {
+		if diff.From != from {
+			return false
+		}
+		from = diff.To
+	}
+	return from == to
+}
+
+func withSerial(soa *dns.SOA, serial uint32) *dns.SOA {
+	soa = dns.Copy(soa).(*dns.SOA)
+	soa.Serial = serial
+	return soa
+}
+
+// ZoneContents returns every record of a zone in transfer order, starting
+// and ending with the SOA, with the signatures of its authoritative RRsets.
+// The DNSKEY, CDS and denial records of a signed zone are stored with its
+// other records, so they go out like any RRset; delegations and glue stay
+// unsigned.
+func ZoneContents(zone string) ([]dns.RR, error) {
+	soa, err := lookupRRSet(zone, dns.TypeSOA, zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(soa) == 0 {
+		return nil, errNoSOA
+	}
+	records := append([]dns.RR{}, soa...)
+
+	types, err := db.GetZoneTypes(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	cuts := map[string]bool{}
+	for name, t := range types {
+		if name != zone && hasType(t, dns.TypeNS) {
+			cuts[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, qtype := range types[name] {
+			if qtype == dns.TypeSOA || qtype == dns.TypeRRSIG {
+				continue
+			}
+
+			var rrset []dns.RR
+			if cuts[name] && qtype != dns.TypeDS && qtype != dns.TypeNSEC || belowCut(name, zone, cuts) {
+				// Delegation NS and glue are not authoritative
+				rrset, err = db.QueryRecords(name, qtype)
+			} else {
+				rrset, err = lookupRRSet(name, qtype, zone)
+			}
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rrset...)
+		}
+	}
+
+	return append(records, soa[0]), nil
+}
+
+// chunkRecords splits records into message-sized groups for the transfer
+func chunkRecords(records []dns.RR) [][]dns.RR {
+	var chunks [][]dns.RR
+	var chunk []dns.RR
+	size := 0
+	for _, rr := range records {
+		n := dns.Len(rr)
+		if len(chunk) > 0 && size+n > axfrChunkSize {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, rr)
+		size += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// transferAllowed applies a zone's transfer policy: the client must be in
+// one of the acl networks when there are any, and have signed with one of
+// keys when there are any. A zone with neither is not transferred.
+func transferAllowed(acl []netip.Prefix, keys []string, client netip.Addr, key string) bool {
+	if len(acl) == 0 && len(keys) == 0 {
+		return false
+	}
+	if len(acl) > 0 && !allowed(acl, client) {
+		return false
+	}
+	return len(keys) == 0 || slices.Contains(keys, key)
+}
+
+// allowed reports whether addr falls in one of the networks of acl
+func allowed(acl []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range acl {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the client address of w without a port or v4-in-v6
+// mapping
+func remoteAddr(w dns.ResponseWriter) netip.Addr {
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"dnslite/db"
+
+	"github.com/miekg/dns"
+)
+
+func TestChunkRecords(t *testing.T) {
+	txt := func(n int) []dns.RR {
+		var records []dns.RR
+		for i := 0; i < n; i++ {
+			records = append(records, &dns.TXT{
+				Hdr: dns.RR_Header{Name: fmt.Sprintf("t%d.example.", i), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat("x", 250)},
+			})
+		}
+		return records
+	}
+	huge := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "huge.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+	}
+	for i := 0; i < 80; i++ {
+		huge.Txt = append(huge.Txt, strings.Repeat("y", 250))
+	}
+
+	tests := []struct {
+		name    string
+		records []dns.RR
+		chunks  int
+	}{
+		{"empty", nil, 0},
+		{"one record", txt(1), 1},
+		{"fits one message", txt(50), 1},
+		{"spills over", txt(100), 2},
+		{"many messages", txt(500), 9},
+		{"oversized record alone", append(txt(1), huge, txt(1)[0]), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkRecords(tt.records)
+			if len(chunks) != tt.chunks {
+				t.Fatalf("got %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			var joined []dns.RR
+			for _, chunk := range chunks {
+				size := 0
+				for _, rr := range chunk {
+					size += dns.Len(rr)
+				}
+				if len(chunk) > 1 && size > axfrChunkSize {
+					t.Errorf("chunk of %d records is %d bytes, over %d", len(chunk), size, axfrChunkSize)
+				}
+				joined = append(joined, chunk...)
+			}
+			if len(joined) != len(tt.records) {
+				t.Fatalf("chunks hold %d records, want %d", len(joined), len(tt.records))
+			}
+			for i := range joined {
+				if joined[i] != tt.records[i] {
+					t.Fatalf("record %d out of order", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLeadsTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		diffs    []db.ZoneDiff
+		from, to uint32
+		want     bool
+	}{
+		{"no diffs", nil, 1, 2, false},
+		{"one step", []db.ZoneDiff{{From: 1, To: 2}}, 1, 2, true},
+		{"chain", []db.ZoneDiff{{From: 1, To: 2}, {From: 2, To: 5}, {From: 5, To: 6}}, 1, 6, true},
+		{"serial wraps", []db.ZoneDiff{{From: 4294967295, To: 1}}, 4294967295, 1, true},
+		{"wrong start", []db.ZoneDiff{{From: 2, To: 3}}, 1, 3, false},
+		{"gap", []db.ZoneDiff{{From: 1, To: 2}, {From: 3, To: 4}}, 1, 4, false},
+		{"stops short", []db.ZoneDiff{{From: 1, To: 2}}, 1, 3, false},
+		{"goes past", []db.ZoneDiff{{From: 1, To: 2}, {From: 2, To: 3}}, 1, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leadsTo(tt.diffs, tt.from, tt.to); got != tt.want {
+				t.Errorf("leadsTo = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferAllowed(t *testing.T) {
+	acl := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")}
+	keys := []string{"xfr-key."}
+	inside, outside := netip.MustParseAddr("192.0.2.53"), netip.MustParseAddr("198.51.100.1")
+
+	tests := []struct {
+		name   string
+		acl    []netip.Prefix
+		keys   []string
+		client netip.Addr
+		key    string
+		want   bool
+	}{
+		{"no policy", nil, nil, inside, "xfr-key.", false},
+		{"acl match", acl, nil, inside, "", true},
+		{"acl match v6", acl, nil, netip.MustParseAddr("2001:db8::53"), "", true},
+		{"acl miss", acl, nil, outside, "", false},
+		{"acl ignores key", acl, nil, outside, "xfr-key.", false},
+		{"key match", nil, keys, outside, "xfr-key.", true},
+		{"unsigned", nil, keys, outside, "", false},
+		{"other key", nil, keys, outside, "other-key.", false},
+		{"acl and key", acl, keys, inside, "xfr-key.", true},
+		{"acl without key", acl, keys, inside, "", false},
+		{"key from outside acl", acl, keys, outside, "xfr-key.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transferAllowed(tt.acl, tt.keys, tt.client, tt.key); got != tt.want {
+				t.Errorf("transferAllowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
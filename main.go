@@ -5,29 +5,72 @@ import (
 	"os"
 	"time"
 
+	"dnslite/cache"
 	"dnslite/config"
 	"dnslite/db"
 	"dnslite/dnssec"
 	"dnslite/handler"
+	"dnslite/notify"
 	"dnslite/api"
+	"dnslite/signer"
 	"dnslite/slave"
+	"dnslite/tsig"
 )
 
 func main() {
 	config.LoadEnv()
+	keys, err := config.TSIGKeys()
+	if err == nil {
+		err = tsig.Load(keys)
+	}
+	if err != nil {
+		log.Fatalf("❌ TSIG keys: %v", err)
+	}
+	for _, key := range config.PeerKeys() {
+		if !tsig.Has(key) {
+			log.Fatalf("❌ TSIG key %q is not in TSIG_KEYS", key)
+		}
+	}
+
 	db.Connect(config.DBURL)
 	defer db.Close()
 	
 	db.Migrate()
-	go db.WatchForChanges()
 
 	role := os.Getenv("SERVER_ROLE")
+	go db.WatchForChanges(func(change db.RecordChange) {
+		if role == "master" {
+			// Re-sign the changed RRset and the SOA whose serial it bumped
+			signer.Changed(change)
+		}
+	})
+
+	db.StartJournalPruner(time.Hour, config.JournalVersions, config.JournalMaxAge)
+
 	switch role {
 	case "master":
 		log.Println("🧠 Running in MASTER mode")
+		if len(config.ZoneSyncKeys) == 0 && config.InsecureSync {
+			log.Println("⚠️ ZONE_SYNC_INSECURE is set: /zone-sync is open to anyone who can reach it")
+		} else if len(config.ZoneSyncKeys) == 0 {
+			log.Println("🔒 /zone-sync is refused until ZONE_SYNC_KEYS is set")
+		}
 		if err := dnssec.LoadAllZoneKeys("secrets"); err != nil {
 			log.Fatalf("DNSSEC load failed: %v", err)
 		}
+		// Publish the DNSKEY, CDS and denial records of the loaded keys
+		// before answering
+		signer.SyncZones()
+		dnssec.StartRolloverScheduler("secrets", time.Hour, func(zone string) {
+			// Stored signatures may come from a key that no longer signs
+			cache.Clear()
+			if err := signer.ResignZone(zone); err != nil {
+				log.Printf("❌ Failed to re-sign %s after a key change: %v", zone, err)
+			}
+		})
+		signer.OnResigned = notify.ZoneChanged
+		signer.StartSigner(time.Hour)
+		notify.Start(config.NotifySecondaries)
 		api.StartAPIServer(":8080")
 
 	case "slave":
@@ -36,7 +79,18 @@ func main() {
 		if err != nil {
 			log.Fatalf("❌ Failed to truncate slave DB: %v", err)
 		}
-		slave.StartSlaveSync(os.Getenv("MASTER_URL"), 5*time.Minute)
+		db.DisableJournal()
+		if url := os.Getenv("MASTER_URL"); url != "" {
+			if config.MasterTSIGKey == "" {
+				if !config.InsecureSync {
+					log.Fatal("❌ MASTER_URL needs MASTER_TSIG_KEY, or ZONE_SYNC_INSECURE=true to sync unsigned")
+				}
+				log.Println("⚠️ ZONE_SYNC_INSECURE is set: syncing unsigned and accepting unsigned NOTIFY from the master")
+			}
+			slave.StartSlaveSync(url, 5*time.Minute)
+		}
+		slave.StartSecondaries(config.SecondaryZones)
+		handler.OnNotify = slave.Notify
 
 	default:
 		log.Fatalf("SERVER_ROLE must be set to 'master' or 'slave'")
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"dnslite/config"
+	"dnslite/db"
+	"dnslite/tsig"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// settle lets a burst of record changes go out as one NOTIFY
+	settle = 2 * time.Second
+
+	// A NOTIFY is resent until the secondary answers (RFC 1996 section 3.6),
+	// waiting twice as long each time
+	maxAttempts  = 5
+	firstTimeout = 2 * time.Second
+)
+
+var (
+	secondaries []config.Peer
+
+	mu       sync.Mutex
+	pending  = map[string]bool{}
+	notified = map[string]uint32{}
+)
+
+// Start sets the secondaries notified for every zone and notifies them of
+// all current zones, so they catch up with changes made while we were down
+func Start(targets []config.Peer) {
+	mu.Lock()
+	secondaries = targets
+	mu.Unlock()
+
+	zones, err := db.GetAllZoneNames()
+	if err != nil {
+		log.Printf("⚠️ Could not load zones to notify: %v", err)
+		return
+	}
+	for _, zone := range zones {
+		ZoneChanged(zone)
+	}
+}
+
+// ZoneChanged schedules a NOTIFY to the zone's secondaries once changes to
+// it settle. Nothing is sent if the serial did not move since the last one.
+func ZoneChanged(zone string) {
+	zone = dns.CanonicalName(zone)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if pending[zone] {
+		return
+	}
+	pending[zone] = true
+	time.AfterFunc(settle, func() { send(zone) })
+}
+
+func send(zone string) {
+	mu.Lock()
+	delete(pending, zone)
+	last, seen := notified[zone]
+	targets := append([]config.Peer{}, secondaries...)
+	mu.Unlock()
+
+	soa, err := db.QuerySOA(zone)
+	if err != nil {
+		log.Printf("⚠️ Could not load SOA of %s to notify: %v", zone, err)
+		return
+	}
+	if seen && soa.Serial == last {
+		return
+	}
+
+	also, err := db.GetAlsoNotify(zone)
+	if err != nil {
+		log.Printf("⚠️ Could not load also_notify of %s: %v", zone, err)
+	}
+	for _, peer := range also {
+		targets = append(targets, config.ParsePeer(peer))
+	}
+
+	mu.Lock()
+	notified[zone] = soa.Serial
+	mu.Unlock()
+
+	for _, target := range targets {
+		go notifyTarget(zone, soa, target)
+	}
+}
+
+// notifyTarget sends a NOTIFY for zone to one secondary, carrying the new
+// SOA as a hint (RFC 1996 section 3.7) and signed with the secondary's TSIG
+// key if it has one, until it answers
+func notifyTarget(zone string, soa *dns.SOA, target config.Peer) {
+	timeout := firstTimeout
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		// Signing strips the TSIG from the message, so each try is built anew
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+		m.Answer = []dns.RR{soa}
+		if target.Key != "" {
+			if err := tsig.Sign(m, target.Key); err != nil {
+				log.Printf("❌ Cannot notify %s of %s: %v", target, zone, err)
+				return
+			}
+		}
+
+		c := &dns.Client{Timeout: timeout, TsigProvider: tsig.Provider}
+		in, _, err := c.Exchange(m, target.Addr)
+		switch {
+		case in == nil:
+			// No answer: try again, waiting longer
+			timeout *= 2
+			continue
+		case in.Rcode == dns.RcodeNotAuth && in.IsTsig() != nil:
+			log.Printf("⚠️ %s rejected the TSIG of NOTIFY for %s: %s", target, zone, dns.RcodeToString[int(in.IsTsig().Error)])
+		case err != nil:
+			log.Printf("⚠️ Bad answer from %s to NOTIFY for %s: %v", target, zone, err)
+		case target.Key != "" && in.IsTsig() == nil:
+			log.Printf("⚠️ %s answered NOTIFY for %s unsigned", target, zone)
+		case in.Rcode != dns.RcodeSuccess:
+			log.Printf("⚠️ %s answered NOTIFY for %s with %s", target, zone, dns.RcodeToString[in.Rcode])
+		default:
+			log.Printf("🔔 Notified %s of %s serial %d", target, zone, soa.Serial)
+		}
+		return
+	}
+	log.Printf("❌ No answer from %s to NOTIFY for %s after %d attempts", target, zone, maxAttempts)
+}
@@ -0,0 +1,83 @@
+package signer
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"dnslite/db"
+	"dnslite/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// settle gathers a burst of record changes, such as a bulk load, so each
+// RRset is re-signed once and each zone's SOA once for the whole burst
+const settle = 2 * time.Second
+
+// OnResigned, if set, is called with a zone once its changes are re-signed
+// and its serial covers them
+var OnResigned func(zone string)
+
+var (
+	changesMu sync.Mutex
+	changed   = map[string]map[db.RRSetKey]bool{}
+
+	// resignMu signs one burst at a time, so a zone changed again while it
+	// is being re-signed waits for the first pass
+	resignMu sync.Mutex
+)
+
+// Changed queues the RRset named by a record change for re-signing along
+// with the SOA and derived records of its zone, once changes to the zone
+// settle
+func Changed(change db.RecordChange) {
+	zone := change.Zone
+	if zone != "" {
+		zone = dns.CanonicalName(zone)
+	}
+	key := db.RRSetKey{Name: dns.CanonicalName(change.Name), Type: change.Qtype()}
+
+	changesMu.Lock()
+	defer changesMu.Unlock()
+	sets, ok := changed[zone]
+	if !ok {
+		sets = map[db.RRSetKey]bool{}
+		changed[zone] = sets
+		time.AfterFunc(settle, func() { resignChanges(zone) })
+	}
+	sets[key] = true
+}
+
+func resignChanges(zone string) {
+	changesMu.Lock()
+	sets := changed[zone]
+	delete(changed, zone)
+	changesMu.Unlock()
+
+	resignMu.Lock()
+	defer resignMu.Unlock()
+	for k := range sets {
+		if err := Resign(k.Name, k.Type); err != nil {
+			log.Printf("⚠️ Could not re-sign %s %s: %v", k.Name, dns.TypeToString[k.Type], err)
+		}
+	}
+	if zone == "" {
+		return
+	}
+	if _, err := syncDerived(zone); err != nil {
+		log.Printf("❌ Could not store DNSSEC records of %s: %v", zone, err)
+	}
+
+	if !dnssec.IsSigned(zone) || IsOnline(zone) {
+		// Nothing stored was re-signed, so the serial the change itself
+		// bumped still covers everything we serve
+		if OnResigned != nil {
+			OnResigned(zone)
+		}
+		return
+	}
+	if err := publish(zone); err != nil {
+		log.Printf("❌ Could not publish %s: %v", zone, err)
+	}
+}
@@ -0,0 +1,132 @@
+package signer
+
+import (
+	"log"
+	"slices"
+
+	"dnslite/cache"
+	"dnslite/db"
+	"dnslite/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// derivedTypes are kept in the records table of a zone we sign from its keys,
+// settings and other records: DNSKEY, CDS, CDNSKEY and NSEC3PARAM at the apex
+// and the NSEC or NSEC3 chain. Storing them lets slaves and transfers carry
+// them like any other RRset.
+var derivedTypes = []uint16{
+	dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY,
+	dns.TypeNSEC3PARAM, dns.TypeNSEC, dns.TypeNSEC3,
+}
+
+// ZoneChain returns the NSEC/NSEC3 chain of a zone we sign, built from its
+// records on first use and cached until the zone changes
+func ZoneChain(zone string) (*dnssec.Chain, error) {
+	if chain := cache.GetChain(zone); chain != nil {
+		return chain, nil
+	}
+
+	types, err := db.GetZoneTypes(zone)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := db.GetDenialConfig(zone)
+	if err != nil {
+		return nil, err
+	}
+	soa, err := db.QuerySOA(zone)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := db.GetCDSMode(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stored derived records may lag behind; the keys and settings do not
+	for name, t := range types {
+		t = slices.DeleteFunc(t, func(rrtype uint16) bool {
+			return slices.Contains(derivedTypes, rrtype)
+		})
+		if len(t) == 0 {
+			delete(types, name)
+		} else {
+			types[name] = t
+		}
+	}
+	apex := append(types[zone], dns.TypeSOA, dns.TypeDNSKEY)
+	if cfg.NSEC3 {
+		apex = append(apex, dns.TypeNSEC3PARAM)
+	}
+	if cds, _ := dnssec.CDSRecords(zone, mode); len(cds) > 0 {
+		apex = append(apex, dns.TypeCDS, dns.TypeCDNSKEY)
+	}
+	types[zone] = apex
+
+	chain := dnssec.BuildChain(zone, types, cfg, min(soa.Hdr.Ttl, soa.Minttl))
+	cache.SetChain(zone, chain)
+	return chain, nil
+}
+
+// SyncZones stores the derived records of every zone we sign
+func SyncZones() {
+	for _, zone := range dnssec.GetAllZones() {
+		if err := SyncZone(zone); err != nil {
+			log.Printf("❌ Could not store DNSSEC records of %s: %v", zone, err)
+		}
+	}
+}
+
+// SyncZone brings the stored derived records of a zone we sign in line with
+// its keys, settings and records, re-signs what changed and publishes it
+func SyncZone(zone string) error {
+	resignMu.Lock()
+	defer resignMu.Unlock()
+
+	changed, err := syncDerived(zone)
+	if err != nil || !changed {
+		return err
+	}
+	return publish(zone)
+}
+
+// syncDerived writes the derived records of zone that differ from what is
+// stored and re-signs those RRsets, reporting whether any did
+func syncDerived(zone string) (bool, error) {
+	if !dnssec.IsSigned(zone) {
+		return false, nil
+	}
+	chain, err := ZoneChain(zone)
+	if err != nil {
+		return false, err
+	}
+	mode, err := db.GetCDSMode(zone)
+	if err != nil {
+		return false, err
+	}
+
+	want := dnssec.DNSKEYs(zone)
+	cds, cdnskey := dnssec.CDSRecords(zone, mode)
+	want = append(want, cds...)
+	want = append(want, cdnskey...)
+	if param := chain.Param(); param != nil {
+		want = append(want, param)
+	}
+	want = append(want, chain.Records()...)
+
+	changed, err := db.SyncRecords(zone, derivedTypes, want)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range changed {
+		cache.Delete(k.Name, k.Type)
+		if err := Resign(k.Name, k.Type); err != nil {
+			log.Printf("⚠️ Could not re-sign %s %s: %v", k.Name, dns.TypeToString[k.Type], err)
+		}
+	}
+	if len(changed) > 0 {
+		log.Printf("🔗 Stored %d changed DNSSEC RRsets of %s", len(changed), zone)
+	}
+	return len(changed) > 0, nil
+}
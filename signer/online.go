@@ -0,0 +1,57 @@
+package signer
+
+import (
+	"log"
+
+	"dnslite/cache"
+	"dnslite/db"
+	"dnslite/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// Signing modes of a zone
+const (
+	ModePresigned = "presigned"
+	ModeOnline    = "online"
+)
+
+// IsOnline reports whether zone is signed on demand rather than from
+// signatures stored in the database. Only servers holding the zone's keys
+// can sign online; everyone else serves what is stored.
+func IsOnline(zone string) bool {
+	if !dnssec.IsSigned(zone) {
+		return false
+	}
+	mode, ok := cache.GetSigningMode(zone)
+	if !ok {
+		var err error
+		if mode, err = db.GetSigningMode(zone); err != nil {
+			log.Printf("⚠️ Could not load signing mode for %s: %v", zone, err)
+			return false
+		}
+		cache.SetSigningMode(zone, mode)
+	}
+	return mode == ModeOnline
+}
+
+// Online returns the RRSIGs of rrset from every active key, signing it on
+// first use and again once a cached signature comes within the refresh
+// window of expiring. Signatures are kept in memory only.
+func Online(rrset []dns.RR, zone string) []dns.RR {
+	if len(rrset) == 0 {
+		return nil
+	}
+	hash := dnssec.RRSetHash(rrset, zone)
+	if sigs := cache.GetSignatures(hash); sigs != nil && dnssec.Fresh(sigs) {
+		return sigs
+	}
+
+	sigs, err := dnssec.SignRRSetAll(rrset, zone)
+	if err != nil {
+		log.Printf("⚠️ Could not sign %s %s: %v", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+		return nil
+	}
+	cache.SetSignatures(hash, sigs)
+	return sigs
+}
@@ -0,0 +1,168 @@
+package signer
+
+import (
+	"log"
+	"time"
+
+	"dnslite/config"
+	"dnslite/db"
+	"dnslite/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// StartSigner re-signs stored RRSIGs on the master before they expire
+func StartSigner(interval time.Duration) {
+	go func() {
+		for {
+			RefreshSignatures()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// published is when each zone last got a new serial from the signer
+var published = map[string]time.Time{}
+
+// RefreshSignatures re-signs every stored RRSIG that expires within the
+// configured refresh window and publishes the zones they belong to. Online
+// zones are published every half refresh window, as their signatures are
+// remade in memory.
+func RefreshSignatures() {
+	resignMu.Lock()
+	defer resignMu.Unlock()
+
+	due, err := db.GetExpiringRRSIGs(time.Now().Add(config.SignatureRefresh))
+	if err != nil {
+		log.Printf("❌ Failed to load expiring RRSIGs: %v", err)
+		return
+	}
+
+	refreshed := 0
+	zones := map[string]bool{}
+	for _, k := range due {
+		if err := Resign(k.Name, k.Type); err != nil {
+			log.Printf("⚠️ Could not re-sign %s %s: %v", k.Name, dns.TypeToString[k.Type], err)
+			continue
+		}
+		if zone, err := signingZone(dns.Fqdn(k.Name), k.Type); err == nil && zone != "" {
+			zones[zone] = true
+		}
+		refreshed++
+	}
+	if refreshed > 0 {
+		log.Printf("🔏 Re-signed %d expiring RRSIGs", refreshed)
+	}
+
+	for _, zone := range dnssec.GetAllZones() {
+		if IsOnline(zone) && time.Since(published[zone]) >= config.SignatureRefresh/2 {
+			zones[zone] = true
+		}
+	}
+	for zone := range zones {
+		if err := publish(zone); err != nil {
+			log.Printf("❌ Could not publish %s: %v", zone, err)
+		}
+	}
+}
+
+// ResignZone re-signs every RRset of a zone with its current keys, stores
+// its derived records and publishes it. It runs after the keys change.
+func ResignZone(zone string) error {
+	resignMu.Lock()
+	defer resignMu.Unlock()
+
+	if _, err := syncDerived(zone); err != nil {
+		return err
+	}
+	if !IsOnline(zone) {
+		types, err := db.GetZoneTypes(zone)
+		if err != nil {
+			return err
+		}
+		for name, t := range types {
+			for _, qtype := range t {
+				if err := Resign(name, qtype); err != nil {
+					log.Printf("⚠️ Could not re-sign %s %s: %v", name, dns.TypeToString[qtype], err)
+				}
+			}
+		}
+	}
+	return publish(zone)
+}
+
+// publish gives zone a new serial after the signer changed what it serves,
+// signs the new SOA and tells OnResigned, so secondaries transfer the zone
+// again rather than keep signatures or keys we have replaced
+func publish(zone string) error {
+	if err := db.BumpSerial(zone); err != nil {
+		return err
+	}
+	published[zone] = time.Now()
+	if err := Resign(zone, dns.TypeSOA); err != nil {
+		return err
+	}
+	if OnResigned != nil {
+		OnResigned(zone)
+	}
+	return nil
+}
+
+// Resign replaces the stored signatures of an RRset with fresh ones from
+// every active key, or drops them if the RRset is gone or not authoritative
+func Resign(name string, qtype uint16) error {
+	name = dns.Fqdn(name)
+	zone, err := signingZone(name, qtype)
+	if err != nil {
+		return err
+	}
+	if zone == "" || !dnssec.IsSigned(zone) {
+		// Not ours to sign; leave it for whoever holds the keys
+		return nil
+	}
+	if IsOnline(zone) {
+		// Signed on demand; drop anything stored while the zone was presigned
+		return db.DeleteRRSIG(name, qtype)
+	}
+
+	cut, err := db.FindZoneCut(name, zone)
+	if err != nil {
+		return err
+	}
+	// The DS and NSEC at a delegation point are the parent's own data
+	if cut != "" && !(name == cut && (qtype == dns.TypeDS || qtype == dns.TypeNSEC)) {
+		return db.DeleteRRSIG(name, qtype)
+	}
+
+	var rrset []dns.RR
+	if qtype == dns.TypeSOA {
+		if soa, err := db.QuerySOA(name); err == nil {
+			rrset = []dns.RR{soa}
+		}
+	} else if rrset, err = db.QueryRecords(name, qtype); err != nil {
+		return err
+	}
+	if len(rrset) == 0 {
+		return db.DeleteRRSIG(name, qtype)
+	}
+
+	sigs, err := dnssec.SignRRSetAll(rrset, zone)
+	if err != nil {
+		return err
+	}
+	return db.ReplaceRRSIGs(name, qtype, sigs)
+}
+
+// signingZone is the zone whose keys sign name/qtype: the enclosing zone,
+// except for DS at a child apex we also host, which the parent signs
+func signingZone(name string, qtype uint16) (string, error) {
+	zone, err := db.FindZone(name)
+	if err != nil || zone == "" || qtype != dns.TypeDS || name != zone {
+		return zone, err
+	}
+	next, end := dns.NextLabel(name, 0)
+	if end {
+		return zone, nil
+	}
+	return db.FindZone(name[next:])
+}
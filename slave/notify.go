@@ -0,0 +1,111 @@
+package slave
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"dnslite/config"
+
+	"github.com/miekg/dns"
+)
+
+// Notify handles a DNS NOTIFY for zone from the given address, signed with
+// the TSIG key named key ("" if unsigned). A zone followed by AXFR/IXFR is
+// checked at once if the sender is one of its primaries; otherwise, if the
+// sender is the HTTP master, just that zone is synced from it. Where a key
+// is configured for the sender the NOTIFY must be signed with it; the master
+// must sign unless the sync was made insecure on purpose. It reports whether
+// the NOTIFY was accepted.
+func Notify(zone string, from netip.Addr, key string) bool {
+	if s, ok := secondaries[zone]; ok {
+		return s.notified(from, key)
+	}
+	if masterURL == "" || config.MasterTSIGKey == "" && !config.InsecureSync {
+		return false
+	}
+	u, err := url.Parse(masterURL)
+	if err != nil || !fromHost(from, u.Host) || !keyMatches(config.MasterTSIGKey, key) {
+		return false
+	}
+	go SyncZoneFromMaster(masterURL, zone)
+	return true
+}
+
+// keyMatches reports whether a message signed with key (already verified)
+// satisfies a peer that requires want, "" meaning no key is required
+func keyMatches(want, key string) bool {
+	return want == "" || dns.CanonicalName(want) == key
+}
+
+// peerRefresh is how often the addresses of the master and the primaries
+// are looked up again
+const peerRefresh = 5 * time.Minute
+
+var (
+	// peerAddrs caches the addresses each peer host resolves to, so a NOTIFY
+	// is checked without a lookup in the DNS handler
+	peerAddrs   = map[string][]netip.Addr{}
+	peerAddrsMu sync.RWMutex
+)
+
+// watchHosts resolves hosts (host or host:port) now and every peerRefresh
+// after, for fromHost
+func watchHosts(hosts []string) {
+	if len(hosts) == 0 {
+		return
+	}
+	resolveHosts(hosts)
+	go func() {
+		for {
+			time.Sleep(peerRefresh)
+			resolveHosts(hosts)
+		}
+	}()
+}
+
+// resolveHosts caches the addresses of hosts. A host that fails to resolve
+// keeps the addresses it had.
+func resolveHosts(hosts []string) {
+	for _, host := range hosts {
+		host = hostOnly(host)
+		var addrs []netip.Addr
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr.Unmap()}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			cancel()
+			if err != nil {
+				log.Printf("⚠️ Could not resolve %s: %v", host, err)
+				continue
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+		peerAddrsMu.Lock()
+		peerAddrs[host] = addrs
+		peerAddrsMu.Unlock()
+	}
+}
+
+// fromHost reports whether addr is one of the addresses host (host or
+// host:port) resolved to when last looked up
+func fromHost(addr netip.Addr, host string) bool {
+	peerAddrsMu.RLock()
+	defer peerAddrsMu.RUnlock()
+	return slices.Contains(peerAddrs[hostOnly(host)], addr.Unmap())
+}
+
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,33 @@
+package slave
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFromHost(t *testing.T) {
+	resolveHosts([]string{"192.0.2.1", "198.51.100.1:5353", "[2001:db8::1]:53"})
+
+	tests := []struct {
+		addr, host string
+		want       bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.1:53", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.2", "192.0.2.1", false},
+		{"198.51.100.1", "198.51.100.1:5353", true},
+		{"2001:db8::1", "[2001:db8::1]:53", true},
+		{"2001:db8::2", "[2001:db8::1]:53", false},
+		// Hosts never looked up match nothing, rather than being resolved
+		// while the NOTIFY waits
+		{"203.0.113.1", "203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+" from "+tt.host, func(t *testing.T) {
+			if got := fromHost(netip.MustParseAddr(tt.addr), tt.host); got != tt.want {
+				t.Errorf("fromHost = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
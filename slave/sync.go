@@ -2,17 +2,39 @@ package slave
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"dnslite/db"
 	"github.com/miekg/dns"
 	"dnslite/api"
 	"dnslite/cache"
+	"dnslite/config"
+	"dnslite/tsig"
 )
 
-func StartSlaveSync(masterURL string, interval time.Duration) {
+var (
+	// masterURL is the /zone-sync endpoint of our master, if we sync by HTTP
+	masterURL string
+
+	// syncMu keeps a NOTIFY-triggered sync from overlapping the periodic one
+	syncMu sync.Mutex
+)
+
+// StartSlaveSync follows the master: every interval it compares the serial
+// of each zone with the master's and syncs the zones that differ. NOTIFY
+// from the master syncs a single zone in between.
+func StartSlaveSync(endpoint string, interval time.Duration) {
+	masterURL = endpoint
+	if u, err := url.Parse(endpoint); err == nil {
+		watchHosts([]string{u.Host})
+	}
 	cache.Clear()
 	api.UpdateLastSync(time.Now())
 	go func() {
@@ -23,61 +45,188 @@ func StartSlaveSync(masterURL string, interval time.Duration) {
 	}()
 }
 
+// SyncZoneFromMaster pulls a single zone from the master
+func SyncZoneFromMaster(masterURL, zone string) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	syncZone(masterURL, dns.Fqdn(strings.ToLower(zone)))
+}
+
+// SyncFromMaster syncs every zone whose serial differs from the master's
+// and drops the zones the master no longer has
 func SyncFromMaster(masterURL string) {
-	resp, err := http.Get(masterURL)
-	if err != nil {
-		log.Println("❌ Failed to contact master:", err)
-		return
-	}
-	defer resp.Body.Close()
+	syncMu.Lock()
+	defer syncMu.Unlock()
 
-	type ZoneFile struct {
-		Zone    string   `json:"zone"`
-		Records []string `json:"records"`
+	var serials []api.ZoneSerial
+	if err := fetch(masterURL, url.Values{"serials": {""}}, &serials); err != nil {
+		log.Println("❌ Failed to list zones on master:", err)
+		return
 	}
-	var zones []ZoneFile
-	if err := json.NewDecoder(resp.Body).Decode(&zones); err != nil {
-		log.Println("❌ Failed to decode master response:", err)
+	local, err := db.GetZoneSerials()
+	if err != nil {
+		log.Println("❌ Failed to load zone serials:", err)
 		return
 	}
 
 	synced := 0
-	for _, z := range zones {
-		log.Printf("📥 Processing zone: %s", z.Zone)
-
-		zoneID, err := db.InsertZone(z.Zone)
-		if err != nil {
-			log.Printf("⚠️ Could not insert zone %s: %v", z.Zone, err)
+	onMaster := map[string]bool{}
+	for _, z := range serials {
+		zone := dns.Fqdn(strings.ToLower(z.Zone))
+		onMaster[zone] = true
+		if _, ok := config.SecondaryZones[zone]; ok {
+			// Transferred from its own primary by AXFR/IXFR
+			continue
+		}
+		if serial, ok := local[zone]; ok && serial == z.Serial {
 			continue
 		}
+		if syncZone(masterURL, zone) {
+			synced++
+		}
+	}
 
-		// Remove existing records for the zone (fresh sync)
-		if err := db.DeleteAllRecordsForZoneID(zoneID); err != nil {
-			log.Printf("❌ Failed to delete existing records for zone %s: %v", z.Zone, err)
+	for zone := range local {
+		if _, ok := config.SecondaryZones[zone]; ok || onMaster[zone] {
+			continue
+		}
+		if err := db.DeleteZone(zone); err != nil {
+			log.Printf("❌ Failed to drop zone %s: %v", zone, err)
 			continue
 		}
+		log.Printf("🗑️ Dropped zone %s, which the master no longer has", zone)
+	}
+
+	log.Printf("🔄 Synced %d zones from master", synced)
+}
 
-		for _, rrStr := range z.Records {
-			rr, err := dns.NewRR(rrStr)
+// syncZone brings one zone up to the master's copy: by the changes since our
+// serial when the master has them, otherwise by replacing the whole zone. It
+// reports whether anything changed.
+func syncZone(masterURL, zone string) bool {
+	params := url.Values{"zone": {zone}}
+	if soa, err := db.QuerySOA(zone); err == nil {
+		params.Set("serial", strconv.FormatUint(uint64(soa.Serial), 10))
+	}
+
+	var zones []api.ZoneFile
+	if err := fetch(masterURL, params, &zones); err != nil {
+		log.Printf("❌ Failed to sync zone %s from master: %v", zone, err)
+		return false
+	}
+	if len(zones) == 0 {
+		log.Printf("⚠️ Master does not have zone %s", zone)
+		return false
+	}
+	z := zones[0]
+
+	if len(z.Diffs) > 0 {
+		soa, ok := parseSOA(z.SOA)
+		if !ok {
+			log.Printf("❌ Invalid SOA for zone %s: %s", zone, z.SOA)
+			return false
+		}
+		diffs := make([]db.ZoneDiff, 0, len(z.Diffs))
+		for _, d := range z.Diffs {
+			deleted, err := parseRecords(d.Deleted)
 			if err != nil {
-				log.Printf("⚠️ Invalid RR in zone %s: %s", z.Zone, rrStr)
-				continue
+				log.Printf("❌ Changes to zone %s from master: %v", zone, err)
+				return false
 			}
+			added, err := parseRecords(d.Added)
+			if err != nil {
+				log.Printf("❌ Changes to zone %s from master: %v", zone, err)
+				return false
+			}
+			diffs = append(diffs, db.ZoneDiff{From: d.From, To: d.To, Deleted: deleted, Added: added})
+		}
+		if err := db.ApplyZoneDiffs(zone, soa, diffs); err != nil {
+			log.Printf("❌ Failed to apply changes to zone %s: %v", zone, err)
+			return false
+		}
+		log.Printf("📥 Zone %s: serial %d → %d in %d steps", zone, diffs[0].From, soa.Serial, len(diffs))
+		return true
+	}
 
-			name := rr.Header().Name
-			qtype := rr.Header().Rrtype
+	if len(z.Records) == 0 {
+		// Already at the master's serial
+		return false
+	}
+	records, err := parseRecords(z.Records)
+	if err != nil {
+		// Storing the rest under the master's serial would keep the zone
+		// incomplete until the next change
+		log.Printf("❌ Zone %s from master: %v", zone, err)
+		return false
+	}
+	if len(records) == 0 || records[0].Header().Rrtype != dns.TypeSOA {
+		log.Printf("❌ Zone %s from master does not start with a SOA", zone)
+		return false
+	}
+	soa := records[0].(*dns.SOA)
+	if err := db.ReplaceZone(zone, soa, records[1:]); err != nil {
+		log.Printf("❌ Failed to store zone %s: %v", zone, err)
+		return false
+	}
+	log.Printf("📥 Zone %s: serial %d, %d records", zone, soa.Serial, len(records)-1)
+	return true
+}
 
-			if qtype == dns.TypeRRSIG {
-				_ = db.StoreRRSIG(name, qtype, rr)
-			} else {
-				if err := db.UpsertRecord(name, qtype, rr); err != nil {
-					log.Printf("❌ Failed to upsert RR %s (%s): %v", name, dns.TypeToString[qtype], err)
-				}
-			}
+// fetch asks the master's /zone-sync for params, signed with our key if we
+// have one, and decodes the answer into v
+func fetch(masterURL string, params url.Values, v any) error {
+	u, err := url.Parse(masterURL)
+	if err != nil {
+		return fmt.Errorf("invalid MASTER_URL: %w", err)
+	}
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("invalid MASTER_URL: %w", err)
+	}
+	if config.MasterTSIGKey != "" {
+		if err := tsig.SignRequest(req, config.MasterTSIGKey); err != nil {
+			return fmt.Errorf("cannot sign request: %w", err)
 		}
-		synced++
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master refused zone sync: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	log.Printf("🔄 Synced %d zones from master", synced)
+// parseRecords reads the records sent by the master. Any that does not
+// parse fails the whole set, since the rest would be stored as if complete.
+func parseRecords(texts []string) ([]dns.RR, error) {
+	records := make([]dns.RR, 0, len(texts))
+	for _, text := range texts {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RR %q: %w", text, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("invalid RR %q", text)
+		}
+		records = append(records, rr)
+	}
+	return records, nil
 }
 
+func parseSOA(text string) (*dns.SOA, bool) {
+	rr, err := dns.NewRR(text)
+	if err != nil {
+		return nil, false
+	}
+	soa, ok := rr.(*dns.SOA)
+	return soa, ok
+}
@@ -0,0 +1,34 @@
+package slave
+
+import "testing"
+
+func TestParseRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		texts   []string
+		want    int
+		wantErr bool
+	}{
+		{"empty", nil, 0, false},
+		{"valid", []string{"example. 3600 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300", "www.example. 300 IN A 192.0.2.1"}, 2, false},
+		{"one invalid", []string{"www.example. 300 IN A 192.0.2.1", "www.example. 300 IN A not-an-address"}, 0, true},
+		{"blank", []string{""}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseRecords(tt.texts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRecords succeeded with %d records, want an error", len(records))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecords: %v", err)
+			}
+			if len(records) != tt.want {
+				t.Errorf("got %d records, want %d", len(records), tt.want)
+			}
+		})
+	}
+}
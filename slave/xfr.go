@@ -0,0 +1,262 @@
+package slave
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"dnslite/api"
+	"dnslite/config"
+	"dnslite/db"
+	"dnslite/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// initialRetry is how often a zone we hold no copy of is retried, before a
+// SOA tells us its retry interval
+const initialRetry = time.Minute
+
+var errUpToDate = errors.New("zone is up to date")
+
+// secondary keeps one zone in step with its external primaries (RFC 1034
+// section 4.3.5): the SOA serial is checked every refresh interval, failed
+// checks are retried every retry interval, and the zone is dropped once no
+// primary has confirmed it for expire
+type secondary struct {
+	zone      string
+	primaries []config.Peer
+	soa       *dns.SOA      // SOA of our copy, nil until the first transfer
+	confirmed time.Time     // last time a primary had our serial or sent a newer one
+	wake      chan struct{} // a NOTIFY cuts the wait for the next check short
+}
+
+// secondaries holds the zones followed by AXFR/IXFR; it is not changed once
+// they are started
+var secondaries = map[string]*secondary{}
+
+// StartSecondaries transfers each zone from its primaries by AXFR/IXFR and
+// keeps it current on the schedule of the zone's SOA timers
+func StartSecondaries(zones map[string][]config.Peer) {
+	var hosts []string
+	for _, primaries := range zones {
+		for _, p := range primaries {
+			hosts = append(hosts, p.Addr)
+		}
+	}
+	watchHosts(hosts)
+
+	for zone, primaries := range zones {
+		s := &secondary{zone: zone, primaries: primaries, wake: make(chan struct{}, 1)}
+		secondaries[zone] = s
+		log.Printf("📡 Secondary for %s from %v", zone, primaries)
+		go func() {
+			for {
+				select {
+				case <-time.After(s.refresh()):
+				case <-s.wake:
+				}
+			}
+		}()
+	}
+}
+
+// notified reports whether from is one of the zone's primaries, signing
+// with that primary's key if it has one, and if so has the zone checked
+// right away, as if its refresh timer had run out (RFC 1996 section 3.11)
+func (s *secondary) notified(from netip.Addr, key string) bool {
+	accepted := slices.ContainsFunc(s.primaries, func(p config.Peer) bool {
+		return fromHost(from, p.Addr) && keyMatches(p.Key, key)
+	})
+	if !accepted {
+		return false
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// refresh checks the primaries once, transferring the zone when it changed,
+// and returns how long to wait before the next check
+func (s *secondary) refresh() time.Duration {
+	for _, primary := range s.primaries {
+		serial, err := querySerial(s.zone, primary)
+		if err != nil {
+			log.Printf("⚠️ SOA query for %s to %s failed: %v", s.zone, primary, err)
+			continue
+		}
+		if s.soa != nil && !db.SerialNewer(serial, s.soa.Serial) {
+			s.confirmed = time.Now()
+			return s.timer(s.soa.Refresh)
+		}
+
+		if err := s.transfer(primary); err != nil && err != errUpToDate {
+			log.Printf("❌ Transfer of %s from %s failed: %v", s.zone, primary, err)
+			continue
+		}
+		s.confirmed = time.Now()
+		api.UpdateLastSync(s.confirmed)
+		return s.timer(s.soa.Refresh)
+	}
+
+	if s.soa == nil {
+		return initialRetry
+	}
+	if time.Since(s.confirmed) > time.Duration(s.soa.Expire)*time.Second {
+		// Stale data must not be served as authoritative (RFC 1035 section 3.3.13)
+		log.Printf("⌛ %s expired: no primary reachable since %s", s.zone, s.confirmed.Format(time.RFC3339))
+		if err := db.DeleteZone(s.zone); err != nil {
+			log.Printf("❌ Failed to drop expired zone %s: %v", s.zone, err)
+			return s.timer(s.soa.Retry)
+		}
+		s.soa = nil
+		return initialRetry
+	}
+	return s.timer(s.soa.Retry)
+}
+
+func (s *secondary) timer(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, time.Second)
+}
+
+// transfer fetches the zone from primary, incrementally when we already hold
+// a copy, and stores it
+func (s *secondary) transfer(primary config.Peer) error {
+	m := new(dns.Msg)
+	if s.soa != nil {
+		m.SetIxfr(s.zone, s.soa.Serial, s.soa.Ns, s.soa.Mbox)
+	} else {
+		m.SetAxfr(s.zone)
+	}
+	if primary.Key != "" {
+		if err := tsig.Sign(m, primary.Key); err != nil {
+			return err
+		}
+	}
+
+	tr := &dns.Transfer{DialTimeout: 5 * time.Second, ReadTimeout: 30 * time.Second, TsigProvider: tsig.Provider}
+	envelopes, err := tr.In(m, primary.Addr)
+	if err != nil {
+		return err
+	}
+	var records []dns.RR
+	for env := range envelopes {
+		if env.Error != nil {
+			return env.Error
+		}
+		records = append(records, env.RR...)
+	}
+
+	if len(records) == 0 || records[0].Header().Rrtype != dns.TypeSOA {
+		return errors.New("response does not start with a SOA")
+	}
+	soa := records[0].(*dns.SOA)
+	if len(records) == 1 {
+		// Single SOA: the primary has nothing newer for us (RFC 1995 section 4)
+		if s.soa != nil && !db.SerialNewer(soa.Serial, s.soa.Serial) {
+			return errUpToDate
+		}
+		return errors.New("transfer holds only the SOA")
+	}
+	last, ok := records[len(records)-1].(*dns.SOA)
+	if !ok || last.Serial != soa.Serial {
+		return errors.New("transfer does not end with the SOA")
+	}
+	body := records[1 : len(records)-1]
+
+	if s.soa != nil && len(body) > 0 && body[0].Header().Rrtype == dns.TypeSOA {
+		diffs, err := parseIXFR(body, s.soa.Serial, soa.Serial)
+		if err != nil {
+			return err
+		}
+		if err := db.ApplyZoneDiffs(s.zone, soa, diffs); err != nil {
+			return err
+		}
+		log.Printf("📥 IXFR of %s from %s: serial %d → %d in %d steps", s.zone, primary, s.soa.Serial, soa.Serial, len(diffs))
+	} else {
+		if err := db.ReplaceZone(s.zone, soa, body); err != nil {
+			return err
+		}
+		log.Printf("📥 AXFR of %s from %s: serial %d, %d records", s.zone, primary, soa.Serial, len(body))
+	}
+	s.soa = soa
+	return nil
+}
+
+// parseIXFR splits the body of an incremental transfer, between the leading
+// and trailing SOA, into its difference sequences: old SOA, deleted records,
+// new SOA, added records (RFC 1995 section 4)
+func parseIXFR(body []dns.RR, from, to uint32) ([]db.ZoneDiff, error) {
+	var diffs []db.ZoneDiff
+	adding := true
+	for _, rr := range body {
+		soa, ok := rr.(*dns.SOA)
+		switch {
+		case !ok && len(diffs) == 0:
+			return nil, errors.New("IXFR sequence does not start with a SOA")
+		case ok && adding:
+			if len(diffs) > 0 && soa.Serial != diffs[len(diffs)-1].To {
+				return nil, fmt.Errorf("IXFR sequence starts at serial %d after ending at %d", soa.Serial, diffs[len(diffs)-1].To)
+			}
+			diffs = append(diffs, db.ZoneDiff{From: soa.Serial})
+			adding = false
+		case ok:
+			diffs[len(diffs)-1].To = soa.Serial
+			adding = true
+		case adding:
+			diffs[len(diffs)-1].Added = append(diffs[len(diffs)-1].Added, rr)
+		default:
+			diffs[len(diffs)-1].Deleted = append(diffs[len(diffs)-1].Deleted, rr)
+		}
+	}
+	if len(diffs) == 0 || !adding || diffs[0].From != from || diffs[len(diffs)-1].To != to {
+		return nil, fmt.Errorf("IXFR does not lead from serial %d to %d", from, to)
+	}
+	return diffs, nil
+}
+
+// querySerial asks primary for the zone's SOA serial, over TCP if the UDP
+// answer is truncated
+func querySerial(zone string, primary config.Peer) (uint32, error) {
+	c := &dns.Client{Timeout: 5 * time.Second, TsigProvider: tsig.Provider}
+	in, err := exchange(c, zone, primary)
+	if err == nil && in.Truncated {
+		c.Net = "tcp"
+		in, err = exchange(c, zone, primary)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if in.Rcode != dns.RcodeSuccess || !in.Authoritative {
+		return 0, fmt.Errorf("not authoritative (%s)", dns.RcodeToString[in.Rcode])
+	}
+	for _, rr := range in.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA in answer")
+}
+
+// exchange sends a SOA query for zone to primary, signed with its key if it
+// has one, in which case the answer must be signed too
+func exchange(c *dns.Client, zone string, primary config.Peer) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	if primary.Key != "" {
+		if err := tsig.Sign(m, primary.Key); err != nil {
+			return nil, err
+		}
+	}
+	in, _, err := c.Exchange(m, primary.Addr)
+	if err == nil && primary.Key != "" && in.IsTsig() == nil {
+		return nil, errors.New("answer is not signed")
+	}
+	return in, err
+}
@@ -0,0 +1,71 @@
+package slave
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseIXFR(t *testing.T) {
+	soa := func(serial uint32) dns.RR {
+		rr, _ := dns.NewRR("example. 3600 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300")
+		rr.(*dns.SOA).Serial = serial
+		return rr
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	oldA, newA := rr("www.example. 300 IN A 192.0.2.1"), rr("www.example. 300 IN A 192.0.2.2")
+	mx := rr("example. 300 IN MX 10 mail.example.")
+
+	type diff struct {
+		from, to       uint32
+		deleted, added int
+	}
+	tests := []struct {
+		name     string
+		body     []dns.RR
+		from, to uint32
+		want     []diff
+	}{
+		{"one version", []dns.RR{soa(1), oldA, soa(2), newA}, 1, 2, []diff{{1, 2, 1, 1}}},
+		{"only additions", []dns.RR{soa(1), soa(2), mx}, 1, 2, []diff{{1, 2, 0, 1}}},
+		{"no changes", []dns.RR{soa(1), soa(2)}, 1, 2, []diff{{1, 2, 0, 0}}},
+		{"several versions", []dns.RR{soa(1), oldA, soa(2), newA, soa(2), soa(3), mx}, 1, 3,
+			[]diff{{1, 2, 1, 1}, {2, 3, 0, 1}}},
+		{"serial wraps", []dns.RR{soa(4294967295), soa(1), mx}, 4294967295, 1, []diff{{4294967295, 1, 0, 1}}},
+		{"empty", nil, 1, 2, nil},
+		{"no leading SOA", []dns.RR{oldA, soa(1), soa(2)}, 1, 2, nil},
+		{"ends in deletions", []dns.RR{soa(1), oldA}, 1, 2, nil},
+		{"wrong start", []dns.RR{soa(2), soa(3)}, 1, 3, nil},
+		{"wrong end", []dns.RR{soa(1), soa(2)}, 1, 3, nil},
+		{"gap between versions", []dns.RR{soa(1), soa(2), soa(3), soa(4)}, 1, 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, err := parseIXFR(tt.body, tt.from, tt.to)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("parseIXFR succeeded with %d diffs, want an error", len(diffs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIXFR: %v", err)
+			}
+			if len(diffs) != len(tt.want) {
+				t.Fatalf("got %d diffs, want %d", len(diffs), len(tt.want))
+			}
+			for i, d := range diffs {
+				got := diff{d.From, d.To, len(d.Deleted), len(d.Added)}
+				if got != tt.want[i] {
+					t.Errorf("diff %d = %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
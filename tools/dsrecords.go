@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"dnslite/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run tools/dsrecords.go <zone>")
+		os.Exit(1)
+	}
+	zone := dns.Fqdn(os.Args[1])
+
+	if err := dnssec.LoadAllZoneKeys("secrets"); err != nil {
+		log.Fatalf("Failed to load DNSSEC keys: %v", err)
+	}
+	records := dnssec.DSRecords(zone)
+	if len(records) == 0 {
+		log.Fatalf("No active keys in secrets/%s", zone)
+	}
+
+	// One SHA-256 and one SHA-384 digest per KSK, ready for the registrar
+	for _, ds := range records {
+		fmt.Println(ds.String())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"dnslite/dnssec"
+)
+
+func main() {
+	secretsDir := flag.String("dir", "secrets", "directory holding one subdirectory of keys per zone")
+	flag.Parse()
+
+	if os.Getenv("DNSSEC_KEK") == "" && os.Getenv("DNSSEC_KEK_FILE") == "" {
+		fmt.Println("Usage: DNSSEC_KEK_FILE=/run/secrets/dnssec-kek go run tools/encryptkeys.go [-dir secrets]")
+		os.Exit(1)
+	}
+
+	// K*.pem from genkey and the legacy key.pem
+	paths, err := filepath.Glob(filepath.Join(*secretsDir, "*", "*.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encrypted, failed := 0, 0
+	for _, path := range paths {
+		changed, err := dnssec.EncryptKeyFile(path)
+		switch {
+		case err != nil:
+			log.Printf("❌ %s: %v", path, err)
+			failed++
+		case changed:
+			log.Printf("🔒 Encrypted %s", path)
+			encrypted++
+		default:
+			log.Printf("✔ %s is already encrypted", path)
+		}
+	}
+
+	log.Printf("✅ Encrypted %d of %d key files", encrypted, len(paths))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -2,82 +2,61 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
+	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
+
+	"dnslite/dnssec"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/miekg/dns"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run tools/genkey.go <zone>")
+	algName := flag.String("alg", "RSASHA256", "DNSSEC algorithm: RSASHA256, ECDSAP256SHA256, ECDSAP384SHA384 or ED25519")
+	ksk := flag.Bool("ksk", false, "generate a key-signing key (SEP flag, signs only the DNSKEY RRset)")
+	state := flag.String("state", dnssec.StateActive, "initial lifecycle state: published (pre-publish only) or active")
+	token := flag.String("pkcs11", "", "generate the key inside the PKCS#11 token with this label (needs PKCS11_MODULE and PKCS11_PIN)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: go run tools/genkey.go [-alg ECDSAP256SHA256] [-ksk] [-state published] [-pkcs11 token] <zone>")
 		os.Exit(1)
 	}
 
-	zone := dns.Fqdn(os.Args[1])
-	ttl := 3600
-
-	// 1. Generate RSA Key
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
-	}
-
-	// 2. Prepare secret dir
-	dir := filepath.Join("secrets", zone)
-	err = os.MkdirAll(dir, 0700)
-	if err != nil {
-		panic(err)
+	alg, ok := dns.StringToAlgorithm[strings.ToUpper(*algName)]
+	if !ok {
+		fmt.Println("❌ Unsupported algorithm:", *algName)
+		os.Exit(1)
 	}
-
-	// 3. Save private key
-	privPath := filepath.Join(dir, "key.pem")
-	privOut, err := os.Create(privPath)
-	if err != nil {
-		panic(err)
+	if *state != dnssec.StateActive && *state != dnssec.StatePublished {
+		fmt.Println("❌ Initial state must be active or published")
+		os.Exit(1)
 	}
-	defer privOut.Close()
-	_ = pem.Encode(privOut, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
-	})
 
-	// 4. Build DNSKEY
-	pubBytes := x509.MarshalPKCS1PublicKey(&priv.PublicKey)
-	pubKeyB64 := base64.StdEncoding.EncodeToString(pubBytes)
+	zone := dns.Fqdn(flag.Arg(0))
+	ttl := 3600
 
-	dnskey := &dns.DNSKEY{
-		Hdr: dns.RR_Header{
-			Name:   zone,
-			Rrtype: dns.TypeDNSKEY,
-			Class:  dns.ClassINET,
-			Ttl:    uint32(ttl),
-		},
-		Flags:     256,
-		Protocol:  3,
-		Algorithm: dns.RSASHA256,
-		PublicKey: pubKeyB64,
+	// 1. Generate the key and write its files to secrets/<zone>/
+	var kp *dnssec.KeyPair
+	var err error
+	if *token != "" {
+		kp, err = dnssec.GenerateTokenKey("secrets", zone, *token, alg, *ksk, uint32(ttl), *state)
+	} else {
+		kp, err = dnssec.GenerateKey("secrets", zone, alg, *ksk, uint32(ttl), *state)
 	}
-
-	// 5. Save public key as dnskey.txt
-	pubPath := filepath.Join(dir, "dnskey.txt")
-	pubOut, err := os.Create(pubPath)
 	if err != nil {
 		panic(err)
 	}
-	defer pubOut.Close()
-	_, _ = pubOut.WriteString(dnskey.String() + "\n")
+	dnskey := kp.Public
 
-	fmt.Println("✅ Key pair generated for", zone)
+	role := "ZSK"
+	if *ksk {
+		role = "KSK"
+	}
+	fmt.Printf("✅ %s %s generated for %s (key tag %d, %s)\n", dns.AlgorithmToString[alg], role, zone, dnskey.KeyTag(), *state)
 
-	// 6. Insert into database
+	// 2. Insert into database
 	dbURL := os.Getenv("DB_URL")
 	if dbURL == "" {
 		fmt.Println("❌ DB_URL not set in env")
@@ -101,12 +80,12 @@ func main() {
 		panic("❌ Failed to insert zone: " + err.Error())
 	}
 
-	// 7. Insert DNSKEY into records
+	// 3. Insert DNSKEY into records
 	_, err = conn.Exec(context.Background(), `
 		INSERT INTO records (zone_id, name, type, ttl, data)
 		VALUES ($1, $2, 'DNSKEY', $3, $4)
 		ON CONFLICT DO NOTHING
-	`, zoneID, zone, ttl, pubKeyB64)
+	`, zoneID, zone, ttl, fmt.Sprintf("%d %d %d %s", dnskey.Flags, dnskey.Protocol, dnskey.Algorithm, dnskey.PublicKey))
 	if err != nil {
 		panic("❌ Failed to insert DNSKEY record: " + err.Error())
 	}
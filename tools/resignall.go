@@ -34,18 +34,31 @@ func main() {
 			if err != nil || len(rrset) == 0 {
 				continue
 			}
-			sig, err := dnssec.SignRRSet(rrset, zone)
+			sigs, err := dnssec.SignRRSetAll(rrset, zone)
 			if err != nil {
 				log.Printf("Sign error for %s %s: %v", p.Name, dns.TypeToString[p.Type], err)
 				continue
 			}
-			err = db.StoreRRSIG(p.Name, p.Type, sig)
+			err = db.ReplaceRRSIGs(p.Name, p.Type, sigs)
 			if err != nil {
 				log.Printf("Store error for %s: %v", p.Name, err)
 			} else {
 				total++
 			}
 		}
+
+		// New signatures need a new serial for secondaries to fetch them
+		if err := db.BumpSerial(zone); err != nil {
+			log.Printf("Serial bump failed for %s: %v", zone, err)
+			continue
+		}
+		soa, err := db.QuerySOA(zone)
+		if err != nil {
+			continue
+		}
+		if sigs, err := dnssec.SignRRSetAll([]dns.RR{soa}, zone); err == nil {
+			db.ReplaceRRSIGs(zone, dns.TypeSOA, sigs)
+		}
 	}
 
 	log.Printf("✅ Re-signed %d RRSIGs across %d zones", total, len(zones))
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"os"
@@ -20,10 +19,13 @@ func main() {
 	zone := dns.Fqdn(os.Args[1])
 
 	// Load keys
-	err := dnssec.LoadKeys("secrets/dnskey.txt", "secrets/key.pem")
+	err := dnssec.LoadAllZoneKeys("secrets")
 	if err != nil {
 		log.Fatalf("Failed to load DNSSEC keys: %v", err)
 	}
+	if !dnssec.IsSigned(zone) {
+		log.Fatalf("No DNSSEC keys in secrets/%s", zone)
+	}
 
 	// Connect to DB
 	db.Connect(os.Getenv("DB_URL"))
@@ -45,13 +47,13 @@ func main() {
 			continue
 		}
 
-		sig, err := dnssec.SignRRSet(rrset, zone)
+		sigs, err := dnssec.SignRRSetAll(rrset, zone)
 		if err != nil {
 			log.Printf("Sign error for %s %s: %v", name, dns.TypeToString[qtype], err)
 			continue
 		}
 
-		err = db.StoreRRSIG(name, qtype, sig)
+		err = db.ReplaceRRSIGs(name, qtype, sigs)
 		if err != nil {
 			log.Printf("Store RRSIG error: %v", err)
 			continue
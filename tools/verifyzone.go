@@ -0,0 +1,576 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"dnslite/config"
+	"dnslite/dnssec"
+	"dnslite/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// rrsetKey identifies an RRset by owner and type
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// zoneData is everything the checks need, however it was loaded
+type zoneData struct {
+	zone    string
+	rrsets  map[rrsetKey][]dns.RR
+	sigs    map[rrsetKey][]*dns.RRSIG
+	parent  []*dns.DS
+	dnskeys []*dns.DNSKEY
+}
+
+// report collects findings; any error makes the run fail
+type report struct {
+	errors, warnings int
+}
+
+func (r *report) ok(format string, args ...any) {
+	fmt.Printf("✅ "+format+"\n", args...)
+}
+
+func (r *report) warn(format string, args ...any) {
+	r.warnings++
+	fmt.Printf("⚠️  "+format+"\n", args...)
+}
+
+func (r *report) fail(format string, args ...any) {
+	r.errors++
+	fmt.Printf("❌ "+format+"\n", args...)
+}
+
+func main() {
+	server := flag.String("server", "127.0.0.1:53", "server to transfer the zone from by AXFR")
+	key := flag.String("key", "", "TSIG key from TSIG_KEYS to sign the AXFR with")
+	dump := flag.String("dump", "", "read the zone from a /zone-sync JSON dump instead of by AXFR")
+	dsFile := flag.String("ds", "", "file with the parent's DS records (defaults to the DS the server answers, or DS rows for the zone in the dump)")
+	warnWithin := flag.Duration("warn", 72*time.Hour, "warn about signatures expiring within this long")
+	verbose := flag.Bool("v", false, "show logging")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: go run tools/verifyzone.go [-server host:port] [-key name] [-dump zone-sync.json] [-ds parent-ds.txt] [-warn 72h] <zone>")
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	zone := dns.Fqdn(strings.ToLower(flag.Arg(0)))
+
+	var data *zoneData
+	var err error
+	if *dump != "" {
+		data, err = loadDump(*dump, zone)
+	} else {
+		data, err = loadAXFR(*server, *key, zone)
+	}
+	if err != nil {
+		fmt.Println("❌ Could not load zone:", err)
+		os.Exit(2)
+	}
+	if *dsFile != "" {
+		if data.parent, err = readDS(*dsFile, zone); err != nil {
+			fmt.Println("❌ Could not read DS file:", err)
+			os.Exit(2)
+		}
+	}
+
+	fmt.Printf("🔍 Verifying %s (%d RRsets)\n", zone, len(data.rrsets))
+	r := &report{}
+	checkKeys(r, data)
+	checkSignatures(r, data, *warnWithin)
+	checkDS(r, data)
+	checkDenial(r, data)
+
+	fmt.Printf("\n%d errors, %d warnings\n", r.errors, r.warnings)
+	if r.errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadAXFR reads the zone as the server serves it, by AXFR, so the records,
+// keys, denial chain and signatures checked are the ones secondaries get.
+// The parent's DS comes from the server too when it hosts the parent.
+func loadAXFR(server, key, zone string) (*zoneData, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(zone)
+	tr := &dns.Transfer{DialTimeout: 5 * time.Second, ReadTimeout: 30 * time.Second}
+	if key != "" {
+		keys, err := config.TSIGKeys()
+		if err == nil {
+			err = tsig.Load(keys)
+		}
+		if err == nil {
+			err = tsig.Sign(m, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tr.TsigProvider = tsig.Provider
+	}
+
+	envelopes, err := tr.In(m, server)
+	if err != nil {
+		return nil, err
+	}
+	data := newZoneData(zone)
+	for env := range envelopes {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		for _, rr := range env.RR {
+			data.add(rr)
+		}
+	}
+	if len(data.rrsets[rrsetKey{zone, dns.TypeSOA}]) == 0 {
+		return nil, fmt.Errorf("transfer of %s from %s held no SOA", zone, server)
+	}
+
+	// A DS owned by the apex belongs to the parent, so it is not in the
+	// transfer; ask for it
+	q := new(dns.Msg)
+	q.SetQuestion(zone, dns.TypeDS)
+	if in, err := dns.Exchange(q, server); err == nil {
+		for _, rr := range in.Answer {
+			if ds, ok := rr.(*dns.DS); ok {
+				data.parent = append(data.parent, ds)
+			}
+		}
+	}
+	return data.finish(), nil
+}
+
+// loadDump reads the zone out of a saved /zone-sync response
+func loadDump(path, zone string) (*zoneData, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		Zone    string   `json:"zone"`
+		Records []string `json:"records"`
+	}
+	if err := json.Unmarshal(raw, &files); err != nil {
+		return nil, err
+	}
+
+	data := newZoneData(zone)
+	found := false
+	for _, f := range files {
+		own := dns.Fqdn(strings.ToLower(f.Zone)) == zone
+		found = found || own
+		for _, line := range f.Records {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				return nil, fmt.Errorf("bad record in %s: %q", f.Zone, line)
+			}
+			if own {
+				data.add(rr)
+			} else if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+				// DS for our zone held by a parent in the same dump
+				data.parent = append(data.parent, ds)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("zone %s not in dump", zone)
+	}
+	return data.finish(), nil
+}
+
+func readDS(path, zone string) ([]*dns.DS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*dns.DS
+	zp := dns.NewZoneParser(f, zone, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if ds, isDS := rr.(*dns.DS); isDS {
+			out = append(out, ds)
+		}
+	}
+	return out, zp.Err()
+}
+
+func newZoneData(zone string) *zoneData {
+	return &zoneData{
+		zone:   zone,
+		rrsets: map[rrsetKey][]dns.RR{},
+		sigs:   map[rrsetKey][]*dns.RRSIG{},
+	}
+}
+
+func (d *zoneData) add(rr dns.RR) {
+	name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		k := rrsetKey{name, sig.TypeCovered}
+		d.sigs[k] = append(d.sigs[k], sig)
+		return
+	}
+	k := rrsetKey{name, rr.Header().Rrtype}
+	for _, have := range d.rrsets[k] {
+		if dns.IsDuplicate(have, rr) {
+			return
+		}
+	}
+	d.rrsets[k] = append(d.rrsets[k], rr)
+}
+
+func (d *zoneData) finish() *zoneData {
+	for _, rr := range d.rrsets[rrsetKey{d.zone, dns.TypeDNSKEY}] {
+		d.dnskeys = append(d.dnskeys, rr.(*dns.DNSKEY))
+	}
+	return d
+}
+
+// cuts returns the delegation points of the zone
+func (d *zoneData) cuts() map[string]bool {
+	cuts := map[string]bool{}
+	for k := range d.rrsets {
+		if k.rtype == dns.TypeNS && k.name != d.zone {
+			cuts[k.name] = true
+		}
+	}
+	return cuts
+}
+
+// authoritative reports whether an RRset must be signed: everything except
+// the NS set at a delegation and glue below one
+func (d *zoneData) authoritative(k rrsetKey, cuts map[string]bool) bool {
+	if cuts[k.name] {
+		return k.rtype == dns.TypeDS || k.rtype == dns.TypeNSEC
+	}
+	for parent := dnssec.ParentName(k.name); parent != "" && parent != d.zone; parent = dnssec.ParentName(parent) {
+		if cuts[parent] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *zoneData) sortedKeys() []rrsetKey {
+	keys := make([]rrsetKey, 0, len(d.rrsets))
+	for k := range d.rrsets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return dnssec.CanonicalLess(keys[i].name, keys[j].name)
+		}
+		return keys[i].rtype < keys[j].rtype
+	})
+	return keys
+}
+
+func checkKeys(r *report, d *zoneData) {
+	if len(d.dnskeys) == 0 {
+		r.fail("%s has no DNSKEY RRset", d.zone)
+		return
+	}
+	sep := 0
+	for _, key := range d.dnskeys {
+		if key.Flags&dns.SEP != 0 {
+			sep++
+		}
+	}
+	r.ok("DNSKEY RRset has %d keys (%d with the SEP flag)", len(d.dnskeys), sep)
+	if sep == 0 {
+		r.warn("no key has the SEP flag; the DS will have to point at a ZSK")
+	}
+}
+
+func checkSignatures(r *report, d *zoneData, warnWithin time.Duration) {
+	if len(d.dnskeys) == 0 {
+		return
+	}
+	now := time.Now()
+	algorithms := map[uint8]bool{}
+	for _, key := range d.dnskeys {
+		algorithms[key.Algorithm] = true
+	}
+
+	cuts := d.cuts()
+	checked := 0
+	for _, k := range d.sortedKeys() {
+		label := k.name + " " + dns.TypeToString[k.rtype]
+		sigs := d.sigs[k]
+		if !d.authoritative(k, cuts) {
+			if len(sigs) > 0 {
+				r.warn("%s is not authoritative but carries %d RRSIGs", label, len(sigs))
+			}
+			continue
+		}
+		checked++
+		if len(sigs) == 0 {
+			r.fail("%s has no RRSIG", label)
+			continue
+		}
+
+		valid := map[uint8]bool{}
+		for _, sig := range sigs {
+			key := findKey(d.dnskeys, sig)
+			switch {
+			case key == nil:
+				r.warn("%s: RRSIG by key %d (%s) has no published DNSKEY", label, sig.KeyTag, dns.AlgorithmToString[sig.Algorithm])
+			case !sig.ValidityPeriod(now):
+				r.fail("%s: RRSIG by key %d is outside its validity period (%s – %s)", label, sig.KeyTag, sigTime(sig.Inception), sigTime(sig.Expiration))
+			case sig.Verify(key, d.rrsets[k]) != nil:
+				r.fail("%s: RRSIG by key %d does not verify: %v", label, sig.KeyTag, sig.Verify(key, d.rrsets[k]))
+			default:
+				valid[sig.Algorithm] = true
+				if !sig.ValidityPeriod(now.Add(warnWithin)) {
+					r.warn("%s: RRSIG by key %d expires %s", label, sig.KeyTag, sigTime(sig.Expiration))
+				}
+			}
+		}
+		if len(valid) == 0 {
+			r.fail("%s has no valid RRSIG", label)
+			continue
+		}
+		// RFC 4035 section 2.2: one signature per algorithm in the DNSKEY RRset
+		for alg := range algorithms {
+			if !valid[alg] {
+				r.fail("%s is not signed with %s", label, dns.AlgorithmToString[alg])
+			}
+		}
+	}
+	r.ok("checked signatures of %d authoritative RRsets", checked)
+}
+
+func checkDS(r *report, d *zoneData) {
+	if len(d.parent) == 0 {
+		r.warn("no DS records to check (use -ds or include the parent zone)")
+		return
+	}
+	signers := map[uint16]bool{}
+	for _, sig := range d.sigs[rrsetKey{d.zone, dns.TypeDNSKEY}] {
+		if key := findKey(d.dnskeys, sig); key != nil && sig.Verify(key, d.rrsets[rrsetKey{d.zone, dns.TypeDNSKEY}]) == nil && sig.ValidityPeriod(time.Now()) {
+			signers[sig.KeyTag] = true
+		}
+	}
+
+	anchored := false
+	for _, ds := range d.parent {
+		var match *dns.DNSKEY
+		for _, key := range d.dnskeys {
+			if want := key.ToDS(ds.DigestType); want != nil && want.KeyTag == ds.KeyTag &&
+				strings.EqualFold(want.Digest, ds.Digest) {
+				match = key
+				break
+			}
+		}
+		switch {
+		case match == nil:
+			r.fail("DS %d (digest type %d) matches no published DNSKEY", ds.KeyTag, ds.DigestType)
+		case !signers[match.KeyTag()]:
+			r.fail("DS %d matches a DNSKEY that does not sign the DNSKEY RRset", ds.KeyTag)
+		default:
+			anchored = true
+			r.ok("DS %d (digest type %d) matches a DNSKEY signing the DNSKEY RRset", ds.KeyTag, ds.DigestType)
+		}
+	}
+	if !anchored {
+		r.fail("no DS links the parent to this zone's DNSKEY RRset")
+	}
+}
+
+// checkDenial checks the NSEC or NSEC3 chain; a signed zone must have one
+func checkDenial(r *report, d *zoneData) {
+	for k := range d.rrsets {
+		if k.rtype == dns.TypeNSEC || k.rtype == dns.TypeNSEC3 {
+			checkNSEC(r, d)
+			checkNSEC3(r, d)
+			return
+		}
+	}
+	r.fail("%s has no NSEC or NSEC3 chain", d.zone)
+}
+
+// checkNSEC validates an NSEC chain when the input contains one: it must
+// visit every authoritative owner in canonical order, loop back to the apex
+// and list the types each owner really has
+func checkNSEC(r *report, d *zoneData) {
+	var chain []*dns.NSEC
+	for k, rrset := range d.rrsets {
+		if k.rtype == dns.TypeNSEC {
+			chain = append(chain, rrset[0].(*dns.NSEC))
+		}
+	}
+	if len(chain) == 0 {
+		return
+	}
+	sort.Slice(chain, func(i, j int) bool {
+		return dnssec.CanonicalLess(chain[i].Hdr.Name, chain[j].Hdr.Name)
+	})
+
+	owners := d.owners(false, false)
+	errs := r.errors
+	for i, nsec := range chain {
+		name := dns.Fqdn(strings.ToLower(nsec.Hdr.Name))
+		next := dns.Fqdn(strings.ToLower(chain[(i+1)%len(chain)].Hdr.Name))
+		if !strings.EqualFold(dns.Fqdn(nsec.NextDomain), next) {
+			r.fail("NSEC at %s points to %s, expected %s", name, nsec.NextDomain, next)
+		}
+		if types, ok := owners[name]; ok {
+			compareBitmap(r, "NSEC at "+name, nsec.TypeBitMap, append(types, dns.TypeNSEC, dns.TypeRRSIG))
+		} else {
+			r.fail("NSEC at %s, which owns no authoritative data", name)
+		}
+		delete(owners, name)
+	}
+	for name := range owners {
+		r.fail("%s is missing from the NSEC chain", name)
+	}
+	if r.errors == errs {
+		r.ok("NSEC chain of %d records is complete", len(chain))
+	}
+}
+
+// checkNSEC3 validates an NSEC3 chain when the input contains one. Opt-out
+// chains may leave out unsigned delegations.
+func checkNSEC3(r *report, d *zoneData) {
+	byHash := map[string]*dns.NSEC3{}
+	for k, rrset := range d.rrsets {
+		if k.rtype == dns.TypeNSEC3 {
+			nsec3 := rrset[0].(*dns.NSEC3)
+			byHash[strings.ToUpper(strings.SplitN(k.name, ".", 2)[0])] = nsec3
+		}
+	}
+	if len(byHash) == 0 {
+		return
+	}
+	params := d.rrsets[rrsetKey{d.zone, dns.TypeNSEC3PARAM}]
+	if len(params) == 0 {
+		r.fail("NSEC3 chain present but no NSEC3PARAM at the apex")
+		return
+	}
+	param := params[0].(*dns.NSEC3PARAM)
+
+	hashes := make([]string, 0, len(byHash))
+	for h := range byHash {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	errs := r.errors
+	for i, h := range hashes {
+		nsec3 := byHash[h]
+		if nsec3.Iterations != param.Iterations || !strings.EqualFold(nsec3.Salt, param.Salt) {
+			r.fail("NSEC3 %s does not use the NSEC3PARAM salt and iterations", h)
+		}
+		if next := hashes[(i+1)%len(hashes)]; !strings.EqualFold(nsec3.NextDomain, next) {
+			r.fail("NSEC3 %s points to %s, expected %s", h, nsec3.NextDomain, next)
+		}
+	}
+
+	cuts := d.cuts()
+	optOut := hasOptOut(byHash)
+	for name, types := range d.owners(true, optOut) {
+		h := dns.HashName(name, param.Hash, param.Iterations, param.Salt)
+		nsec3, ok := byHash[h]
+		if !ok {
+			if !optOut || !d.insecure(name, cuts) {
+				r.fail("%s (%s) is missing from the NSEC3 chain", name, h)
+			}
+			continue
+		}
+		if len(types) > 0 && !d.insecure(name, cuts) {
+			types = append(types, dns.TypeRRSIG)
+		}
+		compareBitmap(r, "NSEC3 for "+name, nsec3.TypeBitMap, types)
+	}
+	if r.errors == errs {
+		r.ok("NSEC3 chain of %d records is complete", len(byHash))
+	}
+}
+
+// owners maps every authoritative owner name and delegation point to the
+// types the denial chain lists for it. The NSEC3 variant adds empty
+// non-terminals, skipping unsigned delegations under opt-out.
+func (d *zoneData) owners(nsec3, optOut bool) map[string][]uint16 {
+	cuts := d.cuts()
+	owners := map[string][]uint16{}
+	for k := range d.rrsets {
+		if k.rtype == dns.TypeNSEC || k.rtype == dns.TypeNSEC3 {
+			continue
+		}
+		if cuts[k.name] && k.rtype != dns.TypeNS && k.rtype != dns.TypeDS || !cuts[k.name] && !d.authoritative(k, cuts) {
+			continue
+		}
+		owners[k.name] = append(owners[k.name], k.rtype)
+	}
+	if nsec3 {
+		ents := map[string]bool{}
+		for name := range owners {
+			if optOut && d.insecure(name, cuts) {
+				continue
+			}
+			for parent := dnssec.ParentName(name); parent != "" && dns.IsSubDomain(d.zone, parent); parent = dnssec.ParentName(parent) {
+				if _, ok := owners[parent]; !ok {
+					ents[parent] = true
+				}
+			}
+		}
+		for name := range ents {
+			owners[name] = nil
+		}
+	}
+	return owners
+}
+
+// insecure reports whether name is a delegation without DS
+func (d *zoneData) insecure(name string, cuts map[string]bool) bool {
+	return cuts[name] && len(d.rrsets[rrsetKey{name, dns.TypeDS}]) == 0
+}
+
+func compareBitmap(r *report, label string, got, want []uint16) {
+	have := map[uint16]bool{}
+	for _, t := range got {
+		have[t] = true
+	}
+	for _, t := range want {
+		if !have[t] {
+			r.fail("%s does not list %s", label, dns.TypeToString[t])
+		}
+		delete(have, t)
+	}
+	for t := range have {
+		r.fail("%s lists %s, which is not there", label, dns.TypeToString[t])
+	}
+}
+
+func hasOptOut(chain map[string]*dns.NSEC3) bool {
+	for _, nsec3 := range chain {
+		if nsec3.Flags&1 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func findKey(keys []*dns.DNSKEY, sig *dns.RRSIG) *dns.DNSKEY {
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm {
+			return key
+		}
+	}
+	return nil
+}
+
+func sigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
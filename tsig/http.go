@@ -0,0 +1,110 @@
+package tsig
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// An HTTP request is signed with an "Authorization: TSIG name:time:nonce:mac"
+// header. The MAC covers the method, the request URI, the time and a random
+// nonce. A captured request cannot be replayed for another zone or after
+// Fudge, and within Fudge each MAC is accepted only once.
+const httpScheme = "TSIG "
+
+// nonceSize is the number of random bytes in a request nonce
+const nonceSize = 16
+
+// errReplayed is returned for a signed request that was already accepted
+var errReplayed = errors.New("TSIG authorization was already used")
+
+var (
+	// seen holds the MACs accepted within the last Fudge, with the time
+	// after which each could no longer pass the time check
+	seen   = map[string]int64{}
+	seenMu sync.Mutex
+)
+
+// SignRequest signs an HTTP request to the /zone-sync API with the named key
+func SignRequest(req *http.Request, name string) error {
+	key, ok := keyring[dns.CanonicalName(name)]
+	if !ok {
+		return fmt.Errorf("unknown TSIG key %s", name)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	mac := key.mac(requestData(req, now, hex.EncodeToString(nonce)))
+	req.Header.Set("Authorization", fmt.Sprintf("%s%s:%d:%x:%s", httpScheme, key.Name, now, nonce,
+		base64.StdEncoding.EncodeToString(mac)))
+	return nil
+}
+
+// VerifyRequest checks the signature of an HTTP request and returns the name
+// of the key that made it
+func VerifyRequest(req *http.Request) (string, error) {
+	auth, ok := strings.CutPrefix(req.Header.Get("Authorization"), httpScheme)
+	if !ok {
+		return "", errors.New("request is not signed")
+	}
+	parts := strings.Split(auth, ":")
+	if len(parts) != 4 {
+		return "", errors.New("malformed TSIG authorization")
+	}
+	key, ok := keyring[dns.CanonicalName(parts[0])]
+	if !ok {
+		return "", dns.ErrSecret
+	}
+	signed, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed TSIG authorization")
+	}
+	if nonce, err := hex.DecodeString(parts[2]); err != nil || len(nonce) != nonceSize {
+		return "", errors.New("malformed TSIG authorization")
+	}
+	now := time.Now().Unix()
+	if d := now - signed; d > Fudge || d < -Fudge {
+		return "", dns.ErrTime
+	}
+	got, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || !hmac.Equal(key.mac(requestData(req, signed, parts[2])), got) {
+		return "", dns.ErrSig
+	}
+	if !firstUse(key.Name+":"+string(got), signed+Fudge, now) {
+		return "", errReplayed
+	}
+	return key.Name, nil
+}
+
+// firstUse records mac as used until expires and reports whether it was
+// not already, dropping the records that have expired by now
+func firstUse(mac string, expires, now int64) bool {
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	for m, until := range seen {
+		if until < now {
+			delete(seen, m)
+		}
+	}
+	if _, ok := seen[mac]; ok {
+		return false
+	}
+	seen[mac] = expires
+	return true
+}
+
+func requestData(req *http.Request, signed int64, nonce string) []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s", req.Method, req.URL.RequestURI(), signed, nonce))
+}
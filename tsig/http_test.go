@@ -0,0 +1,107 @@
+package tsig
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	keyring, seen = map[string]Key{}, map[string]int64{}
+	if err := Load("sync-key:c2VjcmV0 other:b3RoZXI="); err != nil {
+		t.Fatal(err)
+	}
+
+	// forged claims the named key but makes the MAC over uri with secret,
+	// as of offset seconds from now
+	nonces := 0
+	forged := func(name, secret, uri string, offset int64) string {
+		signed := time.Now().Unix() + offset
+		nonces++
+		nonce := fmt.Sprintf("%032x", nonces)
+		req := httptest.NewRequest("GET", uri, nil)
+		mac := keyring[secret].mac(requestData(req, signed, nonce))
+		return fmt.Sprintf("%s%s:%d:%s:%s", httpScheme, name, signed, nonce, base64.StdEncoding.EncodeToString(mac))
+	}
+	authorization := func(uri string, offset int64) string {
+		return forged("sync-key.", "sync-key.", uri, offset)
+	}
+	const uri = "/zone-sync?zone=example."
+	replayed := authorization(uri, 0)
+	nonce := fmt.Sprintf("%032x", 0)
+
+	tests := []struct {
+		name    string
+		auth    string
+		wantKey string
+		wantErr error // nil for any error when wantKey is ""
+	}{
+		{"signed now", authorization(uri, 0), "sync-key.", nil},
+		{"inside fudge, behind", authorization(uri, -Fudge+10), "sync-key.", nil},
+		{"inside fudge, ahead", authorization(uri, Fudge-10), "sync-key.", nil},
+		{"too old", authorization(uri, -Fudge-10), "", dns.ErrTime},
+		{"from the future", authorization(uri, Fudge+10), "", dns.ErrTime},
+		{"for another request", authorization("/zone-sync?zone=other.", 0), "", dns.ErrSig},
+		{"by another key", forged("sync-key.", "other.", uri, 0), "", dns.ErrSig},
+		{"first use", replayed, "sync-key.", nil},
+		{"replayed", replayed, "", errReplayed},
+		{"unknown key", "TSIG nobody.:1:" + nonce + ":AAAA", "", dns.ErrSecret},
+		{"unsigned", "", "", nil},
+		{"other scheme", "Bearer token", "", nil},
+		{"malformed", "TSIG sync-key.:AAAA", "", nil},
+		{"without nonce", fmt.Sprintf("TSIG sync-key.:%d:AAAA", time.Now().Unix()), "", nil},
+		{"bad time", "TSIG sync-key.:now:" + nonce + ":AAAA", "", nil},
+		{"short nonce", fmt.Sprintf("TSIG sync-key.:%d:abcd:AAAA", time.Now().Unix()), "", nil},
+		{"MAC not base64", fmt.Sprintf("TSIG sync-key.:%d:%s:!!", time.Now().Unix(), nonce), "", dns.ErrSig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", uri, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			key, err := VerifyRequest(req)
+			if tt.wantKey != "" {
+				if err != nil || key != tt.wantKey {
+					t.Fatalf("VerifyRequest = %q, %v; want %q", key, err, tt.wantKey)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("VerifyRequest accepted the request as %q", key)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyRequest error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	keyring = map[string]Key{}
+	if err := Load("hmac-sha512:sync-key:c2VjcmV0"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/zone-sync?serials", nil)
+	if err := SignRequest(req, "Sync-Key"); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := VerifyRequest(req); err != nil || key != "sync-key." {
+		t.Fatalf("VerifyRequest = %q, %v; want sync-key.", key, err)
+	}
+	// Signing again makes a new nonce, so the request is accepted again
+	if err := SignRequest(req, "Sync-Key"); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := VerifyRequest(req); err != nil || key != "sync-key." {
+		t.Fatalf("VerifyRequest of the re-signed request = %q, %v; want sync-key.", key, err)
+	}
+	if err := SignRequest(req, "nobody"); err == nil {
+		t.Error("SignRequest with an unknown key succeeded")
+	}
+}
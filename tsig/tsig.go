@@ -0,0 +1,150 @@
+package tsig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+// Fudge is the clock skew allowed between signer and verifier (RFC 8945
+// section 10)
+const Fudge = 300
+
+// Key is a shared secret for transaction signatures (RFC 8945)
+type Key struct {
+	Name      string // canonical key name, as BIND and Knot send it
+	Algorithm string // dns.HmacSHA256, dns.HmacSHA384 or dns.HmacSHA512
+	Secret    []byte
+}
+
+var keyring = map[string]Key{}
+
+func (k Key) mac(data []byte) []byte {
+	var h hash.Hash
+	switch k.Algorithm {
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, k.Secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, k.Secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, k.Secret)
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Load fills the keyring from keys in the "[algorithm:]name:secret" form of
+// dig -y and kdig -y, separated by commas or whitespace. The algorithm is
+// hmac-sha256 unless given; the secret is base64, as tsig-keygen and keymgr
+// print it.
+func Load(spec string) error {
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		parts := strings.Split(entry, ":")
+		if len(parts) == 2 {
+			parts = append([]string{"hmac-sha256"}, parts...)
+		}
+		if len(parts) != 3 || parts[1] == "" {
+			return fmt.Errorf("key %q is not [algorithm:]name:secret", entry)
+		}
+
+		alg := dns.CanonicalName(parts[0])
+		switch alg {
+		case dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("key %s: unsupported algorithm %s", parts[1], parts[0])
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil || len(secret) == 0 {
+			return fmt.Errorf("key %s: secret is not base64", parts[1])
+		}
+
+		name := dns.CanonicalName(parts[1])
+		keyring[name] = Key{Name: name, Algorithm: alg, Secret: secret}
+	}
+	return nil
+}
+
+// Has reports whether the keyring holds a key called name
+func Has(name string) bool {
+	_, ok := keyring[dns.CanonicalName(name)]
+	return ok
+}
+
+// Sign adds a TSIG for the named key to m, to be computed as it is written.
+// The signature is stripped from m on the way out, so a resent message must
+// be signed again.
+func Sign(m *dns.Msg, name string) error {
+	key, ok := keyring[dns.CanonicalName(name)]
+	if !ok {
+		return fmt.Errorf("unknown TSIG key %s", name)
+	}
+	m.SetTsig(key.Name, key.Algorithm, Fudge, time.Now().Unix())
+	return nil
+}
+
+// Size is how much a TSIG by the named key adds to a message
+func Size(name string) int {
+	key, ok := keyring[dns.CanonicalName(name)]
+	if !ok {
+		return 0
+	}
+	macSize := map[string]int{dns.HmacSHA256: 32, dns.HmacSHA384: 48, dns.HmacSHA512: 64}[key.Algorithm]
+	return dns.Len(&dns.TSIG{
+		Hdr:       dns.RR_Header{Name: key.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: key.Algorithm,
+		MACSize:   uint16(macSize),
+		MAC:       strings.Repeat("00", macSize),
+	})
+}
+
+// Rcode maps a verification error from the dns package to the TSIG error
+// to report (RFC 8945 section 5.2)
+func Rcode(err error) uint16 {
+	switch {
+	case errors.Is(err, dns.ErrSecret), errors.Is(err, dns.ErrKeyAlg):
+		return dns.RcodeBadKey
+	case errors.Is(err, dns.ErrTime):
+		return dns.RcodeBadTime
+	}
+	return dns.RcodeBadSig
+}
+
+// Provider signs and verifies messages with the keyring; the key must be
+// used with the algorithm it was configured for
+var Provider dns.TsigProvider = provider{}
+
+type provider struct{}
+
+func (provider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, ok := keyring[dns.CanonicalName(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+
+	return key.mac(msg), nil
+}
+
+func (p provider) Verify(msg []byte, t *dns.TSIG) error {
+	mac, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(mac, got) {
+		return dns.ErrSig
+	}
+	return nil
+}
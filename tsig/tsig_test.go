@@ -0,0 +1,79 @@
+package tsig
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []Key // nil with wantErr
+		wantErr bool
+	}{
+		{"empty", "", []Key{}, false},
+		{"default algorithm", "xfr:c2VjcmV0", []Key{{"xfr.", dns.HmacSHA256, []byte("secret")}}, false},
+		{"explicit algorithm", "hmac-sha512:Sync.Key.:c2VjcmV0",
+			[]Key{{"sync.key.", dns.HmacSHA512, []byte("secret")}}, false},
+		{"several keys", "a:c2VjcmV0, hmac-sha384:b:b3RoZXI=\nc:Zm9v",
+			[]Key{{"a.", dns.HmacSHA256, []byte("secret")}, {"b.", dns.HmacSHA384, []byte("other")}, {"c.", dns.HmacSHA256, []byte("foo")}}, false},
+		{"name only", "xfr", nil, true},
+		{"too many fields", "hmac-sha256:xfr:c2VjcmV0:extra", nil, true},
+		{"empty name", ":c2VjcmV0", nil, true},
+		{"unsupported algorithm", "hmac-md5:xfr:c2VjcmV0", nil, true},
+		{"secret not base64", "xfr:not base64!", nil, true},
+		{"empty secret", "xfr:", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring = map[string]Key{}
+			err := Load(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load(%q) succeeded, want an error", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load(%q): %v", tt.spec, err)
+			}
+			if len(keyring) != len(tt.want) {
+				t.Fatalf("keyring holds %d keys, want %d", len(keyring), len(tt.want))
+			}
+			for _, want := range tt.want {
+				got, ok := keyring[want.Name]
+				if !ok {
+					t.Fatalf("key %s missing", want.Name)
+				}
+				if got.Name != want.Name || got.Algorithm != want.Algorithm || string(got.Secret) != string(want.Secret) {
+					t.Errorf("key %s = %+v, want %+v", want.Name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRcode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want uint16
+	}{
+		{dns.ErrSecret, dns.RcodeBadKey},
+		{dns.ErrKeyAlg, dns.RcodeBadKey},
+		{dns.ErrTime, dns.RcodeBadTime},
+		{fmt.Errorf("verifying: %w", dns.ErrTime), dns.RcodeBadTime},
+		{dns.ErrSig, dns.RcodeBadSig},
+		{errors.New("something else"), dns.RcodeBadSig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := Rcode(tt.err); got != tt.want {
+				t.Errorf("Rcode = %s, want %s", dns.RcodeToString[int(got)], dns.RcodeToString[int(tt.want)])
+			}
+		})
+	}
+}